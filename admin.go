@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction"
+	"github.com/sirupsen/logrus"
+)
+
+// diskStatus is returned by /disks on the admin port
+type diskStatus struct {
+	ListenDir                   string  `json:"listen-dir"`
+	Dir                         string  `json:"dir"`
+	MinPercentBlocksFree        float64 `json:"min-percent-blocks-free"`
+	EvictUntilPercentBlocksFree float64 `json:"evict-until-percent-blocks-free"`
+	PercentBlocksFree           float64 `json:"percent-blocks-free"`
+	BytesFree                   uint64  `json:"bytes-free"`
+	BytesUsed                   uint64  `json:"bytes-used"`
+	Error                       string  `json:"error,omitempty"`
+}
+
+// newAdminMux returns the handlers of the admin API, shared by all disks
+func newAdminMux(disks []diskConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/disks", func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]diskStatus, 0, len(disks))
+		for _, d := range disks {
+			status := diskStatus{
+				ListenDir:                   d.ListenDir,
+				Dir:                         d.Dir,
+				MinPercentBlocksFree:        *d.MinPercentBlocksFree,
+				EvictUntilPercentBlocksFree: *d.EvictUntilPercentBlocksFree,
+			}
+			var err error
+			status.PercentBlocksFree, status.BytesFree, status.BytesUsed, err = diskutil.GetDiskUsage(d.Dir)
+			if err != nil {
+				status.Error = err.Error()
+			}
+			statuses = append(statuses, status)
+		}
+		writeJSON(w, statuses)
+	})
+	mux.HandleFunc("/evict/plan", func(w http.ResponseWriter, r *http.Request) {
+		selected, freePercent, ok := evictArgs(w, r, disks)
+		if !ok {
+			return
+		}
+		plans := make([]*eviction.Plan, 0, len(selected))
+		for _, d := range selected {
+			plans = append(plans, d.notify.Plan(freePercent))
+		}
+		writeJSON(w, plans)
+	})
+	mux.HandleFunc("/evict", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		selected, freePercent, ok := evictArgs(w, r, disks)
+		if !ok {
+			return
+		}
+		results := make([]evictResult, 0, len(selected))
+		for _, d := range selected {
+			result := evictResult{ListenDir: d.ListenDir, Dir: d.Dir}
+			var err error
+			result.Files, result.Bytes, err = d.notify.Evict(r.Context(), freePercent)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("evicting %s: %v", d.Dir, err), http.StatusInternalServerError)
+				return
+			}
+			results = append(results, result)
+		}
+		writeJSON(w, results)
+	})
+	mux.HandleFunc("/trash/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		selected, _, ok := evictArgs(w, r, disks)
+		if !ok {
+			return
+		}
+		filter := eviction.RestoreFilter{Workspace: r.URL.Query().Get("workspace")}
+		for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			v := r.URL.Query().Get(name)
+			if v == "" {
+				continue
+			}
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+		results := make([]evictResult, 0, len(selected))
+		for _, d := range selected {
+			result := evictResult{ListenDir: d.ListenDir, Dir: d.Dir}
+			var err error
+			result.Files, result.Bytes, err = d.notify.Restore(filter)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+		writeJSON(w, results)
+	})
+	return mux
+}
+
+// evictResult is returned by /evict and /trash/restore on the admin port
+type evictResult struct {
+	ListenDir string `json:"listen-dir"`
+	Dir       string `json:"dir"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	Error     string `json:"error,omitempty"`
+}
+
+// evictArgs returns the disks selected by the listen-dir parameter, all of
+// them by default, and the free-percent parameter, TopkFreePercent by
+// default. It writes the error response of invalid parameters.
+func evictArgs(w http.ResponseWriter, r *http.Request, disks []diskConfig) ([]diskConfig, float64, bool) {
+	freePercent := float64(eviction.TopkFreePercent)
+	if v := r.URL.Query().Get("free-percent"); v != "" {
+		var err error
+		if freePercent, err = strconv.ParseFloat(v, 64); err != nil || freePercent < 0 || freePercent > 100 {
+			http.Error(w, "free-percent must be a percentage", http.StatusBadRequest)
+			return nil, 0, false
+		}
+	}
+	listenDir := r.URL.Query().Get("listen-dir")
+	if listenDir == "" {
+		return disks, freePercent, true
+	}
+	for _, d := range disks {
+		if filepath.Clean(listenDir) == filepath.Clean(d.ListenDir) {
+			return []diskConfig{d}, freePercent, true
+		}
+	}
+	http.Error(w, "unknown listen-dir", http.StatusNotFound)
+	return nil, 0, false
+}
+
+// writeJSON writes v as the indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.WithError(err).Error("Failed to write admin response")
+	}
+}
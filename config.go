@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hawkingrei/hoshino/eviction"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the file passed with --config
+type config struct {
+	Disks []diskConfig `yaml:"disks"`
+}
+
+// diskConfig is one --listen-dir / --dir pair, unset thresholds and path
+// mapping rules fall back to the flags, pin and ttl rules add to the --pin
+// and --ttl ones (the disk's ttl rules are checked first), workspaces and
+// classes override the --workspace and --class ones of the same name and
+// class-rules are checked before --class-rule, and rules replaces --rules
+type diskConfig struct {
+	ListenDir                   string   `yaml:"listen-dir"`
+	Dir                         string   `yaml:"dir"`
+	MinPercentBlocksFree        *float64 `yaml:"min-percent-blocks-free"`
+	EvictUntilPercentBlocksFree *float64 `yaml:"evict-until-percent-blocks-free"`
+	EmergencyPercentBlocksFree  *float64 `yaml:"emergency-percent-blocks-free"`
+	PathMap                     []string `yaml:"path-map"`
+	Pin                         []string `yaml:"pin"`
+	TTL                         []string `yaml:"ttl"`
+	Workspaces                  []string `yaml:"workspaces"`
+	Classes                     []string `yaml:"classes"`
+	ClassRules                  []string `yaml:"class-rules"`
+	Rules                       string   `yaml:"rules"`
+
+	pathMapping eviction.PathMapping
+	pins        eviction.PinRules
+	ttls        eviction.TTLRules
+	workspaces  eviction.Workspaces
+	classes     eviction.Classes
+	notify      *eviction.Notify // Set once the disk is started
+}
+
+// loadConfig reads and validates the config at path, an empty path
+// results in an empty config
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range cfg.Disks {
+		d := &cfg.Disks[i]
+		for _, rule := range d.PathMap {
+			if err := d.pathMapping.Set(rule); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		for _, rule := range d.Pin {
+			if err := d.pins.Set(rule); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		for _, rule := range d.TTL {
+			if err := d.ttls.Set(rule); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		for _, workspace := range d.Workspaces {
+			if err := d.workspaces.Set(workspace); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		for _, class := range d.Classes {
+			if err := d.classes.Weights.Set(class); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		for _, rule := range d.ClassRules {
+			if err := d.classes.Rules.Set(rule); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+		if d.Rules != "" {
+			if _, err := eviction.LoadRules(d.Rules); err != nil {
+				return nil, fmt.Errorf("disk %q: %w", d.ListenDir, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// resolveDisks returns the disks of cfg plus the pair given by
+// --listen-dir and --dir, with the flag defaults filled in
+func resolveDisks(cfg *config) ([]diskConfig, error) {
+	disks := append([]diskConfig(nil), cfg.Disks...)
+	if *ListenDir != "" || *dir != "" {
+		disks = append(disks, diskConfig{ListenDir: *ListenDir, Dir: *dir})
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("--dir and --listen-dir or disks in --config must be set")
+	}
+	seen := make(map[string]bool)
+	for i := range disks {
+		d := &disks[i]
+		if d.ListenDir == "" || d.Dir == "" {
+			return nil, fmt.Errorf("disk %q: both listen-dir and dir must be set", d.ListenDir+d.Dir)
+		}
+		listenDir := filepath.Clean(d.ListenDir)
+		if seen[listenDir] {
+			return nil, fmt.Errorf("listen-dir %q is configured twice", d.ListenDir)
+		}
+		seen[listenDir] = true
+		if d.MinPercentBlocksFree == nil {
+			d.MinPercentBlocksFree = minPercentBlocksFree
+		}
+		if d.EvictUntilPercentBlocksFree == nil {
+			d.EvictUntilPercentBlocksFree = evictUntilPercentBlocksFree
+		}
+		if d.EmergencyPercentBlocksFree == nil {
+			d.EmergencyPercentBlocksFree = emergencyPercentBlocksFree
+		}
+		if *d.EmergencyPercentBlocksFree > 0 && *d.EmergencyPercentBlocksFree >= *d.MinPercentBlocksFree {
+			return nil, fmt.Errorf("disk %q: emergency-percent-blocks-free must be below min-percent-blocks-free", d.ListenDir)
+		}
+		if len(d.pathMapping) == 0 {
+			d.pathMapping = pathMapping
+		}
+		if d.Rules == "" {
+			d.Rules = *rulesPath
+		}
+		d.pins = append(append(eviction.PinRules(nil), pinRules...), d.pins...)
+		d.ttls = append(d.ttls[:len(d.ttls):len(d.ttls)], ttlRules...)
+		merged := make(eviction.Workspaces)
+		for name, ws := range workspaces {
+			merged[name] = ws
+		}
+		for name, ws := range d.workspaces {
+			merged[name] = ws
+		}
+		d.workspaces = merged
+		weights := make(eviction.ClassWeights)
+		for name, weight := range classWeights {
+			weights[name] = weight
+		}
+		for name, weight := range d.classes.Weights {
+			weights[name] = weight
+		}
+		d.classes.Weights = weights
+		d.classes.Rules = append(d.classes.Rules[:len(d.classes.Rules):len(d.classes.Rules)], classRules...)
+	}
+	return disks, nil
+}
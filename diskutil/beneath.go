@@ -0,0 +1,323 @@
+package diskutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrEscapes is returned for keys that resolve outside of the cache root,
+// by being absolute, by going up with .. or through a symlink.
+var ErrEscapes = errors.New("path escapes the cache root")
+
+// The changes to the cache dir go through directory fds opened beneath the
+// cache root with openat2(RESOLVE_BENEATH), so a key can't reach a file
+// outside of it whatever the symlinks on the way. Kernels without openat2
+// fall back to opening one component at a time without following symlinks.
+
+// Delete deletes the file at key, a symlink is deleted rather than its
+// target.
+func (c *Cache) Delete(key string) error {
+	dir, name, err := c.openParent(key, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := unix.Unlinkat(dir, name, 0); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: c.KeyToPath(key), Err: err}
+	}
+	return nil
+}
+
+// Rename moves the entry at oldKey to newKey, creating the directories
+// leading to newKey. It fails with an error matching os.ErrExist when
+// newKey exists and with one matching syscall.EXDEV when both are on
+// different filesystems.
+func (c *Cache) Rename(oldKey, newKey string) error {
+	oldDir, oldName, err := c.openParent(oldKey, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldDir)
+	newDir, newName, err := c.openParent(newKey, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newDir)
+	err = unix.Renameat2(oldDir, oldName, newDir, newName, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL {
+		// the filesystem doesn't support RENAME_NOREPLACE
+		if statErr := unix.Fstatat(newDir, newName, new(unix.Stat_t), unix.AT_SYMLINK_NOFOLLOW); statErr == nil {
+			err = unix.EEXIST
+		} else {
+			err = unix.Renameat(oldDir, oldName, newDir, newName)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "renameat", Old: c.KeyToPath(oldKey), New: c.KeyToPath(newKey), Err: err}
+	}
+	return nil
+}
+
+// Deleter deletes cache entries keeping the directories holding them open,
+// so that the entries of a directory are deleted relative to a single
+// directory fd instead of resolving the directory for each of them. It is
+// not safe for concurrent use, Close releases the fds.
+type Deleter struct {
+	c       *Cache
+	maxDirs int
+	dirs    map[string]int
+	order   []string // Open directories, oldest first
+}
+
+// NewDeleter returns a Deleter keeping up to maxDirs directories open.
+func (c *Cache) NewDeleter(maxDirs int) *Deleter {
+	if maxDirs < 1 {
+		maxDirs = 1
+	}
+	return &Deleter{c: c, maxDirs: maxDirs, dirs: make(map[string]int)}
+}
+
+// Delete deletes the file at key like Cache.Delete.
+func (d *Deleter) Delete(key string) error {
+	parent, name, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	dir, ok := d.dirs[parent]
+	if !ok {
+		if dir, err = d.c.openDir(parent, false); err != nil {
+			return err
+		}
+		if len(d.order) == d.maxDirs {
+			unix.Close(d.dirs[d.order[0]])
+			delete(d.dirs, d.order[0])
+			d.order = d.order[1:]
+		}
+		d.dirs[parent] = dir
+		d.order = append(d.order, parent)
+	}
+	if err := unix.Unlinkat(dir, name, 0); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: d.c.KeyToPath(key), Err: err}
+	}
+	return nil
+}
+
+// Close closes the directories kept open.
+func (d *Deleter) Close() {
+	for _, dir := range d.dirs {
+		unix.Close(dir)
+	}
+	d.dirs = make(map[string]int)
+	d.order = nil
+}
+
+// RemoveAll deletes key and everything below it, without following
+// symlinks. A missing key is not an error.
+func (c *Cache) RemoveAll(key string) error {
+	dir, name, err := c.openParent(key, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := removeAllAt(dir, name); err != nil {
+		return &os.PathError{Op: "removeall", Path: c.KeyToPath(key), Err: err}
+	}
+	return nil
+}
+
+// openParent opens the directory holding key beneath the cache root,
+// creating it if create is set, and returns it with the last element of
+// key.
+func (c *Cache) openParent(key string, create bool) (int, string, error) {
+	parent, name, err := splitKey(key)
+	if err != nil {
+		return -1, "", err
+	}
+	dir, err := c.openDir(parent, create)
+	return dir, name, err
+}
+
+// splitKey splits key into its directory and last element, refusing keys
+// that leave the cache root.
+func splitKey(key string) (string, string, error) {
+	key = filepath.Clean(key)
+	if key == "." || !filepath.IsLocal(key) {
+		return "", "", &os.PathError{Op: "open", Path: key, Err: ErrEscapes}
+	}
+	parent, name := filepath.Split(key)
+	return filepath.Clean(parent), name, nil
+}
+
+// openDir opens the directory parent beneath the cache root, creating it
+// if create is set.
+func (c *Cache) openDir(parent string, create bool) (int, error) {
+	root, err := unix.Open(c.diskRoot, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: c.diskRoot, Err: err}
+	}
+	if parent == "." {
+		return root, nil
+	}
+	defer unix.Close(root)
+	var dir int
+	if create {
+		dir, err = mkdirBeneath(root, parent)
+	} else {
+		dir, err = openBeneath(root, parent)
+	}
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: c.KeyToPath(parent), Err: err}
+	}
+	return dir, nil
+}
+
+// openBeneath opens the directory path relative to the directory fd root
+// without leaving it.
+func openBeneath(root int, path string) (int, error) {
+	fd, err := unix.Openat2(root, path, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	switch err {
+	case nil:
+		return fd, nil
+	case unix.EXDEV:
+		return -1, ErrEscapes
+	case unix.ENOSYS, unix.EPERM:
+		// no openat2, or a seccomp filter denying it
+		return openNoFollow(root, path)
+	}
+	return -1, err
+}
+
+// openNoFollow opens the directory path relative to the directory fd root
+// one component at a time, refusing symlinks. path holds no .. component.
+func openNoFollow(root int, path string) (int, error) {
+	fd, err := unix.FcntlInt(uintptr(root), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range strings.Split(path, string(os.PathSeparator)) {
+		next, err := unix.Openat(fd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err == unix.ELOOP || err == unix.ENOTDIR {
+			return -1, ErrEscapes
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// mkdirBeneath is openBeneath creating the missing directories of path.
+func mkdirBeneath(root int, path string) (int, error) {
+	fd, err := unix.FcntlInt(uintptr(root), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range strings.Split(path, string(os.PathSeparator)) {
+		if err := unix.Mkdirat(fd, name, 0755); err != nil && err != unix.EEXIST {
+			unix.Close(fd)
+			return -1, err
+		}
+		next, err := openBeneath(fd, name)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// removeAllAt deletes name in the directory fd dir and everything below it.
+func removeAllAt(dir int, name string) error {
+	err := unix.Unlinkat(dir, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR {
+		return err
+	}
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, child := range names {
+		if err := removeAllAt(fd, child); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	f.Close()
+	if err := unix.Unlinkat(dir, name, unix.AT_REMOVEDIR); err != nil && err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// RemoveEmptyDirs deletes the empty directories below key and key itself
+// if it ends up empty, without following symlinks. The directories that
+// hold files are kept.
+func (c *Cache) RemoveEmptyDirs(key string) error {
+	dir, name, err := c.openParent(key, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	if err := removeEmptyAt(dir, name); err != nil {
+		return &os.PathError{Op: "removeempty", Path: c.KeyToPath(key), Err: err}
+	}
+	return nil
+}
+
+// removeEmptyAt deletes the directory name in the directory fd dir if it
+// only holds empty directories.
+func removeEmptyAt(dir int, name string) error {
+	fd, err := unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT || err == unix.ENOTDIR || err == unix.ELOOP {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	children, err := f.ReadDir(-1)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, child := range children {
+		if !child.IsDir() {
+			continue
+		}
+		if err := removeEmptyAt(fd, child.Name()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	f.Close()
+	err = unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+	if err != nil && err != unix.ENOENT && err != unix.ENOTEMPTY && err != unix.EEXIST {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package diskutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBeneath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "victim"), []byte("x"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "ws/cas"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "ws/cas/a"), []byte("a"), 0644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "ws/out")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "victim"), filepath.Join(root, "ws/link")))
+	c := NewCache(root)
+
+	for _, key := range []string{"../" + filepath.Base(outside) + "/victim", filepath.Join(outside, "victim"), "ws/out/victim", "."} {
+		err := c.Delete(key)
+		require.True(t, errors.Is(err, ErrEscapes), "%s: %v", key, err)
+	}
+	require.True(t, errors.Is(c.Rename("ws/cas/a", "ws/out/a"), ErrEscapes))
+	require.True(t, errors.Is(c.RemoveAll("ws/out/victim"), ErrEscapes))
+	require.FileExists(t, filepath.Join(outside, "victim"))
+
+	// the link goes, not its target
+	require.NoError(t, c.Delete("ws/link"))
+	require.FileExists(t, filepath.Join(outside, "victim"))
+	require.True(t, os.IsNotExist(c.Delete("ws/link")))
+
+	require.NoError(t, c.Rename("ws/cas/a", "trash/1/ws/cas/a"))
+	require.FileExists(t, filepath.Join(root, "trash/1/ws/cas/a"))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "ws/cas/a"), []byte("b"), 0644))
+	require.True(t, errors.Is(c.Rename("trash/1/ws/cas/a", "ws/cas/a"), os.ErrExist))
+
+	// RemoveAll doesn't follow the link into outside
+	require.NoError(t, c.RemoveAll("ws"))
+	require.NoDirExists(t, filepath.Join(root, "ws"))
+	require.FileExists(t, filepath.Join(outside, "victim"))
+	require.NoError(t, c.RemoveAll("ws"))
+}
+
+func TestOpenNoFollow(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a/b"), 0755))
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Join(root, "a/out")))
+	fd, err := os.Open(root)
+	require.NoError(t, err)
+	defer fd.Close()
+	dir, err := openNoFollow(int(fd.Fd()), "a/b")
+	require.NoError(t, err)
+	require.NoError(t, os.NewFile(uintptr(dir), "a/b").Close())
+	_, err = openNoFollow(int(fd.Fd()), "a/out")
+	require.Equal(t, ErrEscapes, err)
+}
+
+func TestDeleter(t *testing.T) {
+	root := t.TempDir()
+	var keys []string
+	for _, dir := range []string{"a", "b", "c"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+		for _, name := range []string{"1", "2"} {
+			require.NoError(t, os.WriteFile(filepath.Join(root, dir, name), nil, 0644))
+			keys = append(keys, filepath.Join(dir, name))
+		}
+	}
+	d := NewCache(root).NewDeleter(2)
+	defer d.Close()
+	for _, key := range keys {
+		require.NoError(t, d.Delete(key))
+		require.LessOrEqual(t, len(d.dirs), 2)
+	}
+	require.True(t, os.IsNotExist(d.Delete("a/1")))
+	require.True(t, errors.Is(d.Delete("../x"), ErrEscapes))
+	names, err := os.ReadDir(filepath.Join(root, "a"))
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "empty"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "trash/1/ws/cas"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "trash/1/ws/ac"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "trash/1/ws/ac/a"), nil, 0644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "trash/1/ws/out")))
+	c := NewCache(root)
+
+	require.NoError(t, c.RemoveEmptyDirs("trash/1"))
+	require.NoDirExists(t, filepath.Join(root, "trash/1/ws/cas"))
+	require.FileExists(t, filepath.Join(root, "trash/1/ws/ac/a"))
+	require.DirExists(t, filepath.Join(outside, "empty"))
+
+	require.NoError(t, os.Remove(filepath.Join(root, "trash/1/ws/ac/a")))
+	require.NoError(t, os.Remove(filepath.Join(root, "trash/1/ws/out")))
+	require.NoError(t, c.RemoveEmptyDirs("trash/1"))
+	require.NoDirExists(t, filepath.Join(root, "trash/1"))
+	require.NoError(t, c.RemoveEmptyDirs("trash/1"))
+	require.True(t, errors.Is(c.RemoveEmptyDirs("../"+filepath.Base(outside)), ErrEscapes))
+}
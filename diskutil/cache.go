@@ -38,15 +38,45 @@ func (c *Cache) DiskRoot() string {
 	return c.diskRoot
 }
 
+// TrashDir is the name of the directories holding evicted entries until
+// they are purged, they are not part of the cache
+const TrashDir = ".trash"
+
 // EntryInfo are returned when getting entries from the cache
 type EntryInfo struct {
 	Path       string
 	LastAccess time.Time
+	Size       int64
+	// Dev is the st_dev of the filesystem holding the entry
+	Dev uint64
 }
 
 // GetEntries walks the cache dir and returns all paths that exist
 // In the future this *may* be made smarter
 func (c *Cache) GetEntries() []EntryInfo {
+	return c.walk(func(string, os.FileInfo) bool { return true })
+}
+
+// GetDevEntries is like GetEntries for the entries on the filesystem dev
+// alone, mounted on mounts. It only descends into the directories on dev
+// and those holding one of its mounts, the other disks are not walked.
+func (c *Cache) GetDevEntries(dev uint64, mounts []string) []EntryInfo {
+	return c.walk(func(path string, f os.FileInfo) bool {
+		if GetDev(f) == dev {
+			return true
+		}
+		for _, mount := range mounts {
+			if strings.HasPrefix(mount, path+string(os.PathSeparator)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// walk returns the entries of the cache dir for which visit is true, it
+// doesn't descend into the directories for which it is false.
+func (c *Cache) walk(visit func(path string, f os.FileInfo) bool) []EntryInfo {
 	entries := []EntryInfo{}
 	// note we swallow errors because we just need to know what keys exist
 	// some keys missing is OK since this is used for eviction, but not returning
@@ -56,19 +86,19 @@ func (c *Cache) GetEntries() []EntryInfo {
 			logrus.WithError(err).Error("error getting some entries")
 			return nil
 		}
-		if !f.IsDir() {
+		if f.IsDir() && (f.Name() == TrashDir || !visit(path, f)) {
+			return filepath.SkipDir
+		}
+		if !f.IsDir() && visit(path, f) {
 			atime := GetATime(path, time.Now())
 			entries = append(entries, EntryInfo{
 				Path:       path,
 				LastAccess: atime,
+				Size:       f.Size(),
+				Dev:        GetDev(f),
 			})
 		}
 		return nil
 	})
 	return entries
 }
-
-// Delete deletes the file at key
-func (c *Cache) Delete(key string) error {
-	return os.Remove(c.KeyToPath(key))
-}
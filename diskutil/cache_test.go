@@ -0,0 +1,22 @@
+package diskutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDevEntries(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "ws/cas"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "ws/cas/a"), []byte("a"), 0644))
+	fi, err := os.Stat(root)
+	require.NoError(t, err)
+	c := NewCache(root)
+	require.Equal(t, c.GetEntries(), c.GetDevEntries(GetDev(fi), nil))
+	// another disk is not walked unless it holds a mount of dev
+	require.Empty(t, c.GetDevEntries(GetDev(fi)+1, nil))
+	require.Empty(t, c.GetDevEntries(GetDev(fi)+1, []string{filepath.Join(root, "ws/cas")}))
+}
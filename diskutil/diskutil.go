@@ -24,6 +24,7 @@ import (
 
 	"github.com/djherbis/atime"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // GetDiskUsage wraps syscall.Statfs for usage in GCing the disk
@@ -50,6 +51,30 @@ func GetATime(path string, defaultTime time.Time) time.Time {
 	return at
 }
 
+// GetBirthTime returns when the file at path was created, or the last time
+// its inode changed (e.g. it was renamed into place) on filesystems that do
+// not record a birth time
+func GetBirthTime(path string) (time.Time, error) {
+	var stat unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME|unix.STATX_CTIME, &stat)
+	if err != nil {
+		return time.Time{}, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+	ts := stat.Ctime
+	if stat.Mask&unix.STATX_BTIME != 0 {
+		ts = stat.Btime
+	}
+	return time.Unix(ts.Sec, int64(ts.Nsec)), nil
+}
+
+// GetDev returns the st_dev of the filesystem holding the file described by f
+func GetDev(f os.FileInfo) uint64 {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
+
 // file path helper
 func exists(path string) bool {
 	_, err := os.Stat(path)
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/hoshino/eviction"
+)
+
+const evictUsage = `usage: hoshino evict plan|run [-admin ADDR] [-listen-dir DIR] [-free-percent N] [-o FILE]
+
+plan asks a running daemon which entries a cleanup pass would delete to get
+N percent of every disk free, and writes the plan as JSON: the victims with
+their size, age, hotness, score and policy, and how many candidates were
+kept by reason. Nothing is deleted.
+
+run makes the daemon run that cleanup pass, it is recorded in the audit log
+with the manual trigger.
+`
+
+// evictCommand runs "hoshino evict", args follow the command name, and
+// returns the exit code
+func evictCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "plan" && args[0] != "run" {
+		fmt.Fprint(stderr, evictUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("evict "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, evictUsage)
+		fs.PrintDefaults()
+	}
+	admin := fs.String("admin", "localhost:9093", "admin address of the daemon, see --admin-host and --admin-port")
+	listenDir := fs.String("listen-dir", "", "plan only the disk with this --listen-dir")
+	freePercent := fs.Float64("free-percent", eviction.TopkFreePercent, "percent of blocks to free on every disk")
+	out := fs.String("o", "", "file to write the result to instead of stdout")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	query := url.Values{}
+	query.Set("free-percent", strconv.FormatFloat(*freePercent, 'g', -1, 64))
+	if *listenDir != "" {
+		query.Set("listen-dir", *listenDir)
+	}
+	method, path := http.MethodGet, "/evict/plan"
+	if args[0] == "run" {
+		method, path = http.MethodPost, "/evict"
+	}
+	w := stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		w = f
+	}
+	err := callAdmin(method, *admin, path, query, w)
+	if f, ok := w.(*os.File); ok && *out != "" {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// callAdmin sends a request to the admin API of the daemon at admin and
+// copies the response to w
+func callAdmin(method, admin, path string, query url.Values, w io.Writer) error {
+	req, err := http.NewRequest(method, "http://"+admin+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,207 @@
+package eviction
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// Triggers of eviction passes, they are recorded in the audit log.
+const (
+	triggerWatermark = "watermark" // A disk ran low on space
+	triggerQuota     = "quota"     // A workspace went over its quota
+	triggerTTL       = "ttl"       // The TTL sweeper
+	triggerManual    = "manual"    // Requested through the admin API
+	triggerPlan      = "plan"      // Planning only, nothing is deleted
+	triggerEmergency = "emergency" // A disk ran below the hard floor
+	triggerPredicted = "predicted" // A disk is about to run low on space
+)
+
+// AuditLog is a JSON lines log of every eviction, with a summary record
+// for each eviction pass. It is rotated once it grows beyond its maximum
+// size, keeping a number of older files suffixed .1 (the newest), .2 and so
+// on. An AuditLog may be shared by several Notify.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// auditEviction is the record of an evicted entry.
+type auditEviction struct {
+	Type       string    `json:"type"` // "evict"
+	Time       time.Time `json:"time"`
+	Dir        string    `json:"dir"`
+	Key        string    `json:"key"`
+	Workspace  string    `json:"workspace"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last-access"`
+	Hotness    uint32    `json:"hotness"`
+	Policy     string    `json:"policy"`
+	Trigger    string    `json:"trigger"`
+	DryRun     bool      `json:"dry-run,omitempty"`
+}
+
+// auditSummary is the record of an eviction pass.
+type auditSummary struct {
+	Type     string         `json:"type"` // "summary"
+	Time     time.Time      `json:"time"`
+	Dir      string         `json:"dir"`
+	Trigger  string         `json:"trigger"`
+	Duration string         `json:"duration"`
+	Files    int            `json:"files"`
+	Bytes    int64          `json:"bytes"`
+	Kept     map[string]int `json:"kept,omitempty"` // Protected candidates by reason
+	DryRun   bool           `json:"dry-run,omitempty"`
+}
+
+// NewAuditLog opens the audit log at path for appending, it is rotated
+// once it exceeds maxSize bytes and at most maxFiles rotated files are kept.
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("audit log %s: the maximum size must be positive", path)
+	}
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// write appends record as one line.
+func (a *AuditLog) write(record interface{}) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode audit record")
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			logrus.WithError(err).WithField("audit-log", a.path).Error("Failed to rotate audit log")
+			if a.f == nil {
+				return
+			}
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logrus.WithError(err).WithField("audit-log", a.path).Error("Failed to write audit log")
+	}
+}
+
+// rotate shifts the rotated files by one and starts a new file, a.mu is
+// held.
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		logrus.WithError(err).WithField("audit-log", a.path).Error("Failed to close audit log")
+	}
+	a.f = nil
+	if a.maxFiles <= 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+	for i := a.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Close closes the audit log, later records are dropped.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// audit records the eviction of entry by g.
+func (n *Notify) audit(g *guard, entry diskutil.EntryInfo, policy string) {
+	g.files++
+	g.bytes += entry.Size
+	if n.auditLog == nil {
+		return
+	}
+	e := n.entry(entry)
+	n.auditLog.write(auditEviction{
+		Type:       "evict",
+		Time:       time.Now(),
+		Dir:        n.path,
+		Key:        e.Key,
+		Workspace:  e.Workspace,
+		Size:       entry.Size,
+		LastAccess: entry.LastAccess,
+		Hotness:    e.Hotness,
+		Policy:     policy,
+		Trigger:    g.trigger,
+		DryRun:     n.dryRun,
+	})
+}
+
+// finish ends the eviction pass of g, logging and recording its summary if
+// it looked at any entry.
+func (n *Notify) finish(g *guard) {
+	g.close()
+	if g.files == 0 && len(g.kept) == 0 {
+		return
+	}
+	summary := auditSummary{
+		Type:     "summary",
+		Time:     time.Now(),
+		Dir:      n.path,
+		Trigger:  g.trigger,
+		Duration: time.Since(g.start).Round(time.Millisecond).String(),
+		Files:    g.files,
+		Bytes:    g.bytes,
+		Kept:     g.kept,
+		DryRun:   n.dryRun,
+	}
+	logrus.WithField("dir", n.path).WithField("trigger", g.trigger).WithField("kept", g.kept).
+		Infof("evicted %d entries, %d bytes in %s", g.files, g.bytes, summary.Duration)
+	n.auditLog.write(summary)
+}
@@ -0,0 +1,83 @@
+package eviction
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/stretchr/testify/require"
+)
+
+func readAudit(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := NewAuditLog(logPath, 1<<20, 2)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var ttls TTLRules
+	require.NoError(t, ttls.Set("pr-*=1h"))
+	var pins PinRules
+	require.NoError(t, pins.Set("pr-1/cas/pinned"))
+	now := time.Now()
+	for _, key := range []string{"pr-1/cas/ab", "pr-1/cas/pinned"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+		at := now.Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), ttls: ttls, pins: pins, auditLog: log}
+	n.expire(now)
+
+	records := readAudit(t, logPath)
+	require.Len(t, records, 2)
+	require.Equal(t, "evict", records[0]["type"])
+	require.Equal(t, "pr-1/cas/ab", records[0]["key"])
+	require.Equal(t, "pr-1", records[0]["workspace"])
+	require.EqualValues(t, 5, records[0]["size"])
+	require.Equal(t, policyTTL, records[0]["policy"])
+	require.Equal(t, triggerTTL, records[0]["trigger"])
+	require.Equal(t, "summary", records[1]["type"])
+	require.EqualValues(t, 1, records[1]["files"])
+	require.EqualValues(t, 5, records[1]["bytes"])
+	require.Equal(t, map[string]interface{}{reasonPinned: 1.0}, records[1]["kept"])
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := NewAuditLog(path, 110, 2)
+	require.NoError(t, err)
+	defer log.Close()
+	record := map[string]string{"key": "0123456789012345678901234567890123456789"} // 52 bytes a line
+	for i := 0; i < 7; i++ {
+		log.write(record)
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		require.NoError(t, err)
+		require.LessOrEqual(t, fi.Size(), int64(110), p)
+	}
+	require.NoFileExists(t, path+".3")
+	require.Len(t, readAudit(t, path), 1)
+	require.Len(t, readAudit(t, path+".1"), 2)
+}
@@ -0,0 +1,205 @@
+package eviction
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// candidateSaveInterval is how often Background saves the candidates.
+const candidateSaveInterval = time.Minute
+
+// candidates queues the cache entries expelled from the top-k. Being
+// expelled only makes an entry the first one evicted once its disk needs
+// space, see evictDisk. An entry leaves the queue when it is evicted, when
+// it is back in the top-k or once it is gone. The queue is saved to path,
+// if set, so that it survives restarts.
+type candidates struct {
+	path string
+
+	mu    sync.Mutex
+	keys  map[string]time.Time // Expelled at, by cache path
+	dirty bool
+}
+
+func newCandidates(path string) *candidates {
+	return &candidates{path: path, keys: make(map[string]time.Time)}
+}
+
+// candidateRecord is a line of the candidates file.
+type candidateRecord struct {
+	Path     string    `json:"path"`
+	Expelled time.Time `json:"expelled"`
+}
+
+// push queues the entry at path, expelled at now.
+func (c *candidates) push(path string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[path]; !ok {
+		c.keys[path] = now
+		c.dirty = true
+	}
+}
+
+// remove takes the entry at path off the queue.
+func (c *candidates) remove(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[path]; ok {
+		delete(c.keys, path)
+		c.dirty = true
+	}
+}
+
+// len returns the number of queued entries.
+func (c *candidates) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.keys)
+}
+
+// queued returns the entries among entries that are queued, the earliest
+// expelled first.
+func (c *candidates) queued(entries []diskutil.EntryInfo) []diskutil.EntryInfo {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	var queued []diskutil.EntryInfo
+	at := make(map[string]time.Time)
+	for _, entry := range entries {
+		if t, ok := c.keys[entry.Path]; ok {
+			queued = append(queued, entry)
+			at[entry.Path] = t
+		}
+	}
+	c.mu.Unlock()
+	sort.SliceStable(queued, func(i, j int) bool {
+		return at[queued[i].Path].Before(at[queued[j].Path])
+	})
+	return queued
+}
+
+// load reads the queue saved by an earlier run, if any.
+func (c *candidates) load() error {
+	if c.path == "" {
+		return nil
+	}
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record candidateRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		if _, ok := c.keys[record.Path]; !ok {
+			c.keys[record.Path] = record.Expelled
+		}
+	}
+	return scanner.Err()
+}
+
+// save drops the entries that are gone from the queue and writes it to
+// the file, replacing it atomically. It does nothing if nothing changed.
+func (c *candidates) save() error {
+	c.mu.Lock()
+	paths := make([]string, 0, len(c.keys))
+	for path := range c.keys {
+		paths = append(paths, path)
+	}
+	c.mu.Unlock()
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			c.remove(path)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for path, at := range c.keys {
+		if err := enc.Encode(candidateRecord{Path: path, Expelled: at}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// CandidatesPath returns the file of stateDir holding the queue of
+// expelled entries of the cache dir dir.
+func CandidatesPath(stateDir, dir string) string {
+	name := strings.ReplaceAll(strings.Trim(filepath.Clean(dir), "/"), "/", "_")
+	return filepath.Join(stateDir, name+".expelled")
+}
+
+// Background maintains the queue of entries expelled from the top-k until
+// ctx is done: it loads it, drops the entries that are gone and saves it
+// every minute and on exit. Nothing is evicted for being expelled alone.
+func (n *Notify) Background(ctx context.Context) {
+	c := n.candidates
+	if err := c.load(); err != nil {
+		logrus.WithError(err).WithField("path", c.path).Error("Failed to load the expelled entries")
+	}
+	ticker := time.NewTicker(candidateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.save(); err != nil {
+				logrus.WithError(err).WithField("path", c.path).Error("Failed to save the expelled entries")
+			}
+			return
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				logrus.WithError(err).WithField("path", c.path).Error("Failed to save the expelled entries")
+			}
+			promMetrics.ExpelledCandidates.WithLabelValues(n.path).Set(float64(c.len()))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/heavykeeper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCandidates(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "queue")
+	c := newCandidates(file)
+	now := time.Now()
+	var entries []diskutil.EntryInfo
+	for i, key := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		entries = append(entries, diskutil.EntryInfo{Path: path})
+		c.push(path, now.Add(-time.Duration(i)*time.Minute))
+	}
+	c.push(entries[0].Path, now.Add(-time.Hour)) // already queued
+	c.remove(entries[1].Path)
+	queued := c.queued(entries)
+	require.Len(t, queued, 2)
+	require.Equal(t, entries[2].Path, queued[0].Path)
+	require.Equal(t, entries[0].Path, queued[1].Path)
+
+	// gone entries are dropped when saving, the rest is loaded back
+	require.NoError(t, os.Remove(entries[2].Path))
+	require.NoError(t, c.save())
+	loaded := newCandidates(file)
+	require.NoError(t, loaded.load())
+	require.Equal(t, 1, loaded.len())
+	require.Len(t, loaded.queued(entries), 1)
+	require.NoError(t, newCandidates(filepath.Join(t.TempDir(), "missing")).load())
+}
+
+func TestPlanCandidates(t *testing.T) {
+	dir := t.TempDir()
+	n := &Notify{
+		path:        dir,
+		disk:        diskutil.NewCache(dir),
+		transfer:    newTransfer(dir, dir),
+		heavykeeper: heavykeeper.NewHeavyKeeper(10, 100, 4, 0.9, 1),
+		openFiles:   newOpenFiles(true, false),
+		candidates:  newCandidates(""),
+	}
+	now := time.Now()
+	for i, key := range []string{"ws/cas/a", "ws/cas/b", "ws/cas/c"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 1024), 0644))
+		at := now.Add(-time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+	// the most recent entry was expelled, it goes first
+	n.candidates.push(filepath.Join(dir, "ws/cas/a"), now)
+	plan := n.Plan(100)
+	require.Len(t, plan.Victims, 3)
+	require.Equal(t, "ws/cas/a", plan.Victims[0].Key)
+	require.Equal(t, policyExpelled, plan.Victims[0].Policy)
+	require.Equal(t, policyScore, plan.Victims[1].Policy)
+	// planning leaves the queue alone
+	require.Equal(t, 1, n.candidates.len())
+}
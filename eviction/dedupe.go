@@ -0,0 +1,78 @@
+package eviction
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDedupe collapses the opens of one file that belong to a single use,
+// Bazel stats, reads and hashes the same CAS file within one action and
+// each of those opens would otherwise count towards its hotness.
+type openDedupe struct {
+	window     time.Duration
+	perSession bool
+
+	seen      map[dedupeKey]time.Time
+	sessions  map[int32]int // Cache of getsid(2) results (key: pid)
+	lastSweep time.Time
+}
+
+type dedupeKey struct {
+	key     string
+	session int
+}
+
+func newOpenDedupe(window time.Duration, perSession bool) *openDedupe {
+	return &openDedupe{
+		window:     window,
+		perSession: perSession,
+		seen:       make(map[dedupeKey]time.Time),
+		sessions:   make(map[int32]int),
+	}
+}
+
+// duplicate reports whether an open of key by pid at now falls in the
+// window started by an earlier open of the same key (in the same session).
+func (d *openDedupe) duplicate(key string, pid int32, now time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+	if now.Sub(d.lastSweep) > d.window {
+		d.sweep(now)
+	}
+	k := dedupeKey{key: key}
+	if d.perSession && pid > 0 {
+		k.session = d.session(pid)
+	}
+	if first, ok := d.seen[k]; ok && now.Sub(first) < d.window {
+		return true
+	}
+	d.seen[k] = now
+	return false
+}
+
+// session returns the session id of pid, or pid itself if it already exited.
+func (d *openDedupe) session(pid int32) int {
+	if sid, ok := d.sessions[pid]; ok {
+		return sid
+	}
+	sid, err := unix.Getsid(int(pid))
+	if err != nil {
+		sid = int(pid)
+	}
+	d.sessions[pid] = sid
+	return sid
+}
+
+// sweep forgets the windows that ended and the cached sessions, whose
+// processes may be gone by now.
+func (d *openDedupe) sweep(now time.Time) {
+	for k, first := range d.seen {
+		if now.Sub(first) >= d.window {
+			delete(d.seen, k)
+		}
+	}
+	d.sessions = make(map[int32]int)
+	d.lastSweep = now
+}
@@ -0,0 +1,29 @@
+package eviction
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenDedupe(t *testing.T) {
+	now := time.Now()
+	pid := int32(os.Getpid())
+
+	d := newOpenDedupe(time.Minute, true)
+	require.False(t, d.duplicate("a", pid, now))
+	require.True(t, d.duplicate("a", pid, now.Add(30*time.Second)))
+	require.False(t, d.duplicate("b", pid, now.Add(30*time.Second)))
+	// the window is not extended by the duplicates
+	require.False(t, d.duplicate("a", pid, now.Add(61*time.Second)))
+
+	// without a pid all opens share one session
+	require.False(t, d.duplicate("c", 0, now))
+	require.True(t, d.duplicate("c", 0, now))
+
+	disabled := newOpenDedupe(0, true)
+	require.False(t, disabled.duplicate("a", pid, now))
+	require.False(t, disabled.duplicate("a", pid, now))
+}
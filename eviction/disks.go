@@ -0,0 +1,164 @@
+package eviction
+
+import (
+	"os"
+	"strings"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// disk is a filesystem holding some of the cache entries, the cache dir
+// usually spans several of them.
+type disk struct {
+	mountPoint string
+	dev        uint64
+	blocksFree float64
+	entries    []diskutil.EntryInfo
+}
+
+// disks groups the cache entries by the filesystem they are stored on, so
+// that every disk is evicted according to its own usage.
+func (n *Notify) disks() []*disk {
+	points := n.mountPoints()
+	byDev := make(map[uint64]*disk)
+	var disks []*disk
+	var pinned int64
+	for _, entry := range n.disk.GetEntries() {
+		if n.pins.pinned(n.disk.PathToKey(entry.Path)) {
+			pinned += entry.Size
+		}
+		d, ok := byDev[entry.Dev]
+		if !ok {
+			d = &disk{dev: entry.Dev, mountPoint: n.mountPointOf(points, entry.Dev, entry.Path)}
+			byDev[entry.Dev] = d
+			disks = append(disks, d)
+		}
+		d.entries = append(d.entries, entry)
+	}
+	promMetrics.PinnedBytes.WithLabelValues(n.path).Set(float64(pinned))
+	usable := disks[:0]
+	for _, d := range disks {
+		blocksFree, _, _, err := n.diskUsage(d.mountPoint)
+		if err != nil {
+			logrus.WithError(err).WithField("mount", d.mountPoint).Error("Failed to get disk usage!")
+			continue
+		}
+		d.blocksFree = blocksFree
+		usable = append(usable, d)
+	}
+	return usable
+}
+
+// diskUsages returns the disks of the cache dir with their usage, without
+// their entries: it only statfs the cache dir and the mounts beneath it.
+func (n *Notify) diskUsages() []*disk {
+	points := n.mountPoints()
+	byDev := make(map[uint64]bool)
+	var disks []*disk
+	for _, point := range n.cacheMounts() {
+		fi, err := os.Stat(point)
+		if err != nil {
+			logrus.WithError(err).WithField("mount", point).Error("Failed to stat mount")
+			continue
+		}
+		dev := diskutil.GetDev(fi)
+		if byDev[dev] {
+			continue
+		}
+		byDev[dev] = true
+		blocksFree, _, _, err := n.diskUsage(point)
+		if err != nil {
+			logrus.WithError(err).WithField("mount", point).Error("Failed to get disk usage!")
+			continue
+		}
+		disks = append(disks, &disk{dev: dev, mountPoint: n.mountPointOf(points, dev, point), blocksFree: blocksFree})
+	}
+	return disks
+}
+
+// devEntries returns the cache entries on dev, walking that disk alone.
+func (n *Notify) devEntries(dev uint64) []diskutil.EntryInfo {
+	var mounts []string
+	for point, d := range n.mountPoints() {
+		if d == dev {
+			mounts = append(mounts, point)
+		}
+	}
+	return n.disk.GetDevEntries(dev, mounts)
+}
+
+// mountPoints returns every mount point of the process with the st_dev of
+// its files.
+func (n *Notify) mountPoints() map[string]uint64 {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to open mountinfo")
+		return nil
+	}
+	defer f.Close()
+	points, err := parseMountinfo(f, "/")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse mountinfo")
+	}
+	return points
+}
+
+// cacheMounts returns the cache dir and the mount points beneath it.
+func (n *Notify) cacheMounts() []string {
+	points := []string{n.path}
+	for point := range n.mountPoints() {
+		if point != n.path && beneath(point, n.path) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// mountPointOf names the filesystem dev holding path: its mount beneath the
+// listen dir if there is one, so that it matches the discovered mounts,
+// otherwise the mount containing path.
+func (n *Notify) mountPointOf(points map[string]uint64, dev uint64, path string) string {
+	var best string
+	for point, d := range points {
+		if d != dev {
+			continue
+		}
+		if beneath(point, n.transfer.listenDir) {
+			return point
+		}
+		if beneath(path, point) && len(point) > len(best) {
+			best = point
+		}
+	}
+	if best == "" {
+		return n.path
+	}
+	return best
+}
+
+// diskUsage returns the usage of the filesystem mounted on point and
+// exports it labelled with point.
+func (n *Notify) diskUsage(point string) (blocksFree float64, bytesFree, bytesUsed uint64, err error) {
+	blocksFree, bytesFree, bytesUsed, err = diskutil.GetDiskUsage(point)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	promMetrics.MountFree.WithLabelValues(point).Set(float64(bytesFree) / 1e9)
+	promMetrics.MountUsed.WithLabelValues(point).Set(float64(bytesUsed) / 1e9)
+	promMetrics.MountTotal.WithLabelValues(point).Set(float64(bytesFree+bytesUsed) / 1e9)
+	return blocksFree, bytesFree, bytesUsed, nil
+}
+
+// forgetDiskUsage stops exporting the usage of the filesystem mounted on point.
+func forgetDiskUsage(point string) {
+	promMetrics.MountFree.DeleteLabelValues(point)
+	promMetrics.MountUsed.DeleteLabelValues(point)
+	promMetrics.MountTotal.DeleteLabelValues(point)
+}
+
+// beneath reports whether path is dir or lies beneath it.
+func beneath(path, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return path == dir || strings.HasPrefix(path, dir+"/") || dir == ""
+}
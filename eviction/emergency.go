@@ -0,0 +1,256 @@
+package eviction
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// emergencyCheckInterval is how often the disks are checked against the
+// hard floor, a statfs each.
+const emergencyCheckInterval = time.Second
+
+// emergencyMaxBackoff bounds how long the passes on a disk in emergency
+// back off after freeing nothing.
+const emergencyMaxBackoff = time.Minute
+
+// emergency evicts from the disks running below a hard floor of free
+// space, faster than the eviction loop would, see WithEmergency.
+type emergency struct {
+	floor   float64       // Percent of blocks free
+	coldAge time.Duration // Workspaces unused for that long are dropped whole, zero never
+
+	mu    sync.Mutex
+	disks map[string]*emergencyDisk // By mount point
+}
+
+// emergencyDisk is the emergency state of a disk.
+type emergencyDisk struct {
+	active bool
+	// After a pass that freed nothing, e.g. every entry left is protected,
+	// the next one waits until next rather than walking the disk again a
+	// second later, twice as long after every such pass.
+	backoff time.Duration
+	next    time.Time
+	dryRun  bool // A dry run pass was made, the only one of the emergency
+}
+
+// emergencyLoop checks the disks of the cache dir every second until ctx
+// is done, evicting from those below the floor on its own goroutine so
+// that a pass waiting on the rate limit doesn't hold it up.
+func (n *Notify) emergencyLoop(ctx context.Context) {
+	ticker := time.NewTicker(emergencyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, point := range n.cacheMounts() {
+				n.checkEmergency(point, now)
+			}
+		}
+	}
+}
+
+// checkEmergency runs emergency passes on the disk mounted on point from
+// the moment it is below the floor until it is back above the minimum free
+// space, where the normal eviction takes over. Passes that free nothing
+// back off, a dry run makes a single pass.
+func (n *Notify) checkEmergency(point string, now time.Time) {
+	blocksFree, _, _, err := n.diskUsage(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to get disk usage!")
+		return
+	}
+	e := n.emergency
+	e.mu.Lock()
+	d, ok := e.disks[point]
+	if !ok {
+		d = &emergencyDisk{}
+		e.disks[point] = d
+	}
+	switch {
+	case !d.active && blocksFree < e.floor:
+		d.active = true
+		logrus.WithField("mount", point).WithField("blocksFree", blocksFree).Warn("disk below the hard floor, emergency eviction")
+	case d.active && blocksFree >= n.minPercentBlocksFree:
+		*d = emergencyDisk{}
+		logrus.WithField("mount", point).WithField("blocksFree", blocksFree).Info("emergency over, back to normal eviction")
+	}
+	active, wait := d.active, d.dryRun || now.Before(d.next)
+	e.mu.Unlock()
+	if !active {
+		promMetrics.EmergencyActive.WithLabelValues(n.path, point).Set(0)
+		return
+	}
+	promMetrics.EmergencyActive.WithLabelValues(n.path, point).Set(1)
+	if wait {
+		return
+	}
+	freed := n.evictEmergency(point)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case n.dryRun:
+		d.dryRun = true
+	case freed > 0:
+		d.backoff, d.next = 0, time.Time{}
+	default:
+		if d.backoff *= 2; d.backoff == 0 {
+			d.backoff = emergencyCheckInterval
+		} else if d.backoff > emergencyMaxBackoff {
+			d.backoff = emergencyMaxBackoff
+		}
+		d.next = now.Add(d.backoff)
+		logrus.WithField("mount", point).WithField("blocksFree", blocksFree).Warnf("emergency pass freed nothing, next one in %s", d.backoff)
+	}
+}
+
+// evictEmergency deletes entries of the disk mounted on point until the
+// minimum free space is reached: it purges the trash of the disk, drops
+// the cold workspaces if configured, then deletes the largest and coldest
+// entries first. It skips the scoring, the rate limit and the trash. It
+// returns the bytes freed.
+func (n *Notify) evictEmergency(point string) int64 {
+	fi, err := os.Stat(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to stat mount")
+		return 0
+	}
+	dev := diskutil.GetDev(fi)
+	promMetrics.EmergencyPasses.WithLabelValues(n.path).Inc()
+	g := n.newGuard(triggerEmergency)
+	g.emergency = true
+	defer n.finish(g)
+	var purged int64
+	if trashed := n.trashBytes(dev); trashed > 0 {
+		n.purgeTrash("pressure", func(b trashBatch) bool { return b.dev == dev })
+		purged = trashed - n.trashBytes(dev)
+	}
+	_, bytesFree, bytesUsed, err := n.diskUsage(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to get disk usage!")
+		return purged
+	}
+	target := int64(float64(bytesFree+bytesUsed)*n.minPercentBlocksFree/100) - int64(bytesFree)
+	if target <= 0 {
+		return purged
+	}
+	freed, entries := n.dropColdWorkspaces(g, dev, n.devEntries(dev), target)
+	sortColdest(entries, g.now)
+	for _, entry := range entries {
+		if freed >= target {
+			break
+		}
+		if deleted, _ := n.evict(g, entry, policyEmergency); deleted {
+			freed += entry.Size
+		}
+	}
+	return purged + freed
+}
+
+// sortColdest sorts entries by size times idle time at now, largest and
+// coldest first.
+func sortColdest(entries []diskutil.EntryInfo, now time.Time) {
+	coldness := func(entry diskutil.EntryInfo) float64 {
+		return float64(entry.Size) * now.Sub(entry.LastAccess).Seconds()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return coldness(entries[i]) > coldness(entries[j])
+	})
+}
+
+// dropColdWorkspaces deletes the workspaces on dev whose entries were all
+// last used more than the cold age ago, oldest first, until target bytes
+// are freed: their entries, then their emptied directories. A workspace with a protected entry,
+// or whose directory is or holds a mount point, is left alone. It returns
+// the bytes freed and the entries of the workspaces left.
+func (n *Notify) dropColdWorkspaces(g *guard, dev uint64, entries []diskutil.EntryInfo, target int64) (int64, []diskutil.EntryInfo) {
+	if n.emergency.coldAge <= 0 {
+		return 0, entries
+	}
+	type workspace struct {
+		name    string
+		newest  time.Time
+		entries []diskutil.EntryInfo
+	}
+	byName := make(map[string]*workspace)
+	var workspaces []*workspace
+	for _, entry := range entries {
+		name := n.workspaceOf(entry.Path)
+		w, ok := byName[name]
+		if !ok {
+			w = &workspace{name: name}
+			byName[name] = w
+			workspaces = append(workspaces, w)
+		}
+		if entry.LastAccess.After(w.newest) {
+			w.newest = entry.LastAccess
+		}
+		w.entries = append(w.entries, entry)
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].newest.Before(workspaces[j].newest)
+	})
+	points := n.cacheMounts()
+	var freed int64
+	var rest []diskutil.EntryInfo
+	for _, w := range workspaces {
+		if freed >= target || g.now.Sub(w.newest) < n.emergency.coldAge || !n.droppable(g, dev, w.name, w.entries, points) {
+			rest = append(rest, w.entries...)
+			continue
+		}
+		// only the entries walked go, each checked again: the workspace may
+		// have been written to since
+		var size int64
+		for _, entry := range w.entries {
+			if deleted, _ := n.evict(g, entry, policyEmergency); deleted {
+				size += entry.Size
+			} else {
+				rest = append(rest, entry)
+			}
+		}
+		if !n.dryRun {
+			if err := n.disk.RemoveEmptyDirs(w.name); err != nil {
+				logrus.WithError(err).WithField("workspace", w.name).Error("Failed to remove the workspace directories")
+			}
+		}
+		logrus.WithField("workspace", w.name).WithField("dry-run", n.dryRun).Warnf("dropped cold workspace, %d bytes", size)
+		freed += size
+	}
+	return freed, rest
+}
+
+// droppable reports whether the workspace name can be dropped: its
+// directory is on dev, is no mount point nor holds one and none of its
+// entries is protected. With disks mounted in the cache dir the first
+// segment of a key is a disk, not a workspace, and is never dropped.
+func (n *Notify) droppable(g *guard, dev uint64, name string, entries []diskutil.EntryInfo, points []string) bool {
+	dir := n.disk.KeyToPath(name)
+	if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() || diskutil.GetDev(fi) != dev {
+		return false
+	}
+	if fi, err := os.Lstat(filepath.Dir(dir)); err != nil || diskutil.GetDev(fi) != dev {
+		// the root of a filesystem
+		return false
+	}
+	for _, point := range points {
+		if beneath(point, dir) {
+			return false
+		}
+	}
+	for _, entry := range entries {
+		if reason := g.protect(entry); reason != "" {
+			g.kept[reason]++
+			return false
+		}
+	}
+	return true
+}
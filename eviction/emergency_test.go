@@ -0,0 +1,150 @@
+package eviction
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortColdest(t *testing.T) {
+	now := time.Now()
+	entries := []diskutil.EntryInfo{
+		{Path: "hot-large", Size: 100, LastAccess: now.Add(-time.Minute)},
+		{Path: "cold-small", Size: 1, LastAccess: now.Add(-time.Hour)},
+		{Path: "cold-large", Size: 100, LastAccess: now.Add(-time.Hour)},
+	}
+	sortColdest(entries, now)
+	require.Equal(t, "cold-large", entries[0].Path)
+	require.Equal(t, "hot-large", entries[1].Path)
+	require.Equal(t, "cold-small", entries[2].Path)
+}
+
+func TestDropColdWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	var pins PinRules
+	require.NoError(t, pins.Set("pinned/cas/a"))
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), pins: pins,
+		emergency: &emergency{coldAge: 24 * time.Hour}}
+	var entries []diskutil.EntryInfo
+	for key, age := range map[string]time.Duration{
+		"old/cas/a":    48 * time.Hour,
+		"old/ac/b":     30 * time.Hour,
+		"older/cas/a":  72 * time.Hour,
+		"recent/cas/a": 48 * time.Hour,
+		"recent/cas/b": time.Hour,
+		"pinned/cas/a": 48 * time.Hour,
+	} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		entries = append(entries, diskutil.EntryInfo{Path: path, Size: 5, LastAccess: now.Add(-age), Dev: diskutil.GetDev(fi)})
+	}
+	g := n.newGuard(triggerEmergency)
+	g.emergency = true
+
+	// a mount point, or a dir holding one, is a disk rather than a workspace
+	require.False(t, n.droppable(g, entries[0].Dev, "older", nil, []string{dir, filepath.Join(dir, "older")}))
+	require.False(t, n.droppable(g, entries[0].Dev, "older", nil, []string{dir, filepath.Join(dir, "older/cas")}))
+
+	// the oldest workspace is enough
+	freed, rest := n.dropColdWorkspaces(g, entries[0].Dev, entries, 5)
+	require.EqualValues(t, 5, freed)
+	require.Len(t, rest, 5)
+	require.NoDirExists(t, filepath.Join(dir, "older"))
+	require.DirExists(t, filepath.Join(dir, "old"))
+
+	freed, rest = n.dropColdWorkspaces(g, entries[0].Dev, rest, 100)
+	require.EqualValues(t, 10, freed)
+	require.Len(t, rest, 3)
+	require.NoDirExists(t, filepath.Join(dir, "old"))
+	require.FileExists(t, filepath.Join(dir, "recent/cas/a"))
+	require.FileExists(t, filepath.Join(dir, "pinned/cas/a"))
+	require.Equal(t, 1, g.kept[reasonPinned])
+	require.Equal(t, 3, g.files)
+
+	// a file written after the walk is not dropped with its workspace
+	path := filepath.Join(dir, "late/cas/a")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	walked := []diskutil.EntryInfo{{Path: path, Size: 5, LastAccess: now.Add(-48 * time.Hour), Dev: diskutil.GetDev(fi)}}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "late/cas/b"), []byte("entry"), 0644))
+	freed, _ = n.dropColdWorkspaces(g, entries[0].Dev, walked, 100)
+	require.EqualValues(t, 5, freed)
+	require.NoFileExists(t, path)
+	require.FileExists(t, filepath.Join(dir, "late/cas/b"))
+}
+
+func TestEmergencyBackoff(t *testing.T) {
+	dir := t.TempDir()
+	mountTmpfs(t, dir)
+	var pins PinRules
+	require.NoError(t, pins.Set("ws/cas/a"))
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), transfer: newTransfer(dir, dir), openFiles: newOpenFiles(true, false),
+		pins: pins, minPercentBlocksFree: 90, emergency: &emergency{floor: 80, disks: make(map[string]*emergencyDisk)}}
+	for _, key := range []string{"ws/cas/a", "ws/cas/b"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 2<<20), 0644))
+	}
+	passes := func() float64 { return testutil.ToFloat64(promMetrics.EmergencyPasses.WithLabelValues(dir)) }
+
+	// a dry run makes a single pass
+	n.dryRun = true
+	now := time.Now()
+	n.checkEmergency(dir, now)
+	n.checkEmergency(dir, now.Add(time.Hour))
+	require.EqualValues(t, 1, passes())
+	require.FileExists(t, filepath.Join(dir, "ws/cas/b"))
+	n.dryRun = false
+	n.emergency.disks = make(map[string]*emergencyDisk)
+
+	// b goes, a is pinned and the next passes free nothing
+	n.checkEmergency(dir, now)
+	require.EqualValues(t, 2, passes())
+	require.NoFileExists(t, filepath.Join(dir, "ws/cas/b"))
+	n.checkEmergency(dir, now)
+	require.EqualValues(t, 3, passes())
+	n.checkEmergency(dir, now.Add(emergencyCheckInterval/2))
+	require.EqualValues(t, 3, passes())
+	n.checkEmergency(dir, now.Add(emergencyCheckInterval))
+	require.EqualValues(t, 4, passes())
+	n.checkEmergency(dir, now.Add(2*emergencyCheckInterval))
+	require.EqualValues(t, 4, passes())
+	n.checkEmergency(dir, now.Add(3*emergencyCheckInterval))
+	require.EqualValues(t, 5, passes())
+}
+
+func TestEmergencyMount(t *testing.T) {
+	dir := t.TempDir()
+	disk1 := filepath.Join(dir, "disk1")
+	mountTmpfs(t, disk1)
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), transfer: newTransfer(dir, dir), openFiles: newOpenFiles(true, false),
+		minPercentBlocksFree: 90, emergency: &emergency{floor: 80, disks: make(map[string]*emergencyDisk)}}
+	for _, key := range []string{"disk1/ws/cas/a", "disk1/ws/cas/b"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 2<<20), 0644))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.emergencyLoop(ctx)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(promMetrics.EmergencyActive.WithLabelValues(dir, disk1)) == 1
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Eventually(t, func() bool {
+		blocksFree, _, _, err := diskutil.GetDiskUsage(disk1)
+		return err == nil && blocksFree >= n.minPercentBlocksFree
+	}, 5*time.Second, 100*time.Millisecond)
+}
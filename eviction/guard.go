@@ -0,0 +1,287 @@
+package eviction
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/sirupsen/logrus"
+)
+
+// maxOpenAge is how long an open without a matching close keeps a file in
+// use, it bounds the damage of close events lost to a full event buffer.
+const maxOpenAge = time.Hour
+
+// openFiles counts the opens of cache entries that were not closed yet, as
+// reported by IN_OPEN and IN_CLOSE_* events. It is updated by the Start
+// loop and read by every eviction path.
+type openFiles struct {
+	mu       sync.Mutex
+	enabled  bool
+	procScan bool
+	opens    map[string]*openCount
+}
+
+type openCount struct {
+	count int
+	last  time.Time // Time of the last open
+}
+
+func newOpenFiles(enabled, procScan bool) *openFiles {
+	return &openFiles{
+		enabled:  enabled,
+		procScan: procScan,
+		opens:    make(map[string]*openCount),
+	}
+}
+
+// mask returns the events needed to track opens.
+func (o *openFiles) mask() uint32 {
+	if !o.enabled {
+		return 0
+	}
+	return inotify.InOpen | inotify.InClose
+}
+
+// event accounts the opens and closes of key in event.
+func (o *openFiles) event(event *inotify.Event, key string, now time.Time) {
+	if !o.enabled {
+		return
+	}
+	delta := 0
+	if event.HasEvent(inotify.InOpen) {
+		delta++
+	}
+	if event.HasEvent(inotify.InCloseWrite) || event.HasEvent(inotify.InCloseNowrite) {
+		delta--
+	}
+	if delta == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.opens[key]
+	if !ok {
+		if delta < 0 {
+			// opened before we started watching
+			return
+		}
+		c = &openCount{}
+		o.opens[key] = c
+	}
+	c.count += delta
+	if delta > 0 {
+		c.last = now
+	}
+	if c.count <= 0 {
+		delete(o.opens, key)
+	}
+}
+
+// busy reports whether key was opened and not closed since.
+func (o *openFiles) busy(key string, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.opens[key]
+	if !ok {
+		return false
+	}
+	if now.Sub(c.last) > maxOpenAge {
+		delete(o.opens, key)
+		return false
+	}
+	return true
+}
+
+// procOpenFiles returns the paths of the files held open by any process
+// visible in /proc, processes of other users need CAP_SYS_PTRACE.
+func procOpenFiles() map[string]struct{} {
+	paths := make(map[string]struct{})
+	pids, err := os.ReadDir("/proc")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to list processes")
+		return paths
+	}
+	for _, pid := range pids {
+		if _, err := strconv.Atoi(pid.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", pid.Name(), "fd")
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			// the process exited or is not ours to look at
+			continue
+		}
+		for _, fd := range fds {
+			if path, err := os.Readlink(filepath.Join(dir, fd.Name())); err == nil {
+				paths[path] = struct{}{}
+			}
+		}
+	}
+	return paths
+}
+
+// Reasons for keeping an entry, they label bazel_cache_evictions_skipped.
+const (
+	reasonPinned   = "pinned"
+	reasonInUse    = "in_use"
+	reasonTooYoung = "too_young"
+	reasonRule     = "rule"
+)
+
+// Policies choosing the entries to evict.
+const (
+	policyScore     = "score"     // Lowest fair share score on a full disk
+	policyQuota     = "quota"     // Oldest of a workspace over its quota
+	policyTTL       = "ttl"       // Past a TTL rule
+	policyExpelled  = "expelled"  // Expelled from the top-k, taken first on a full disk
+	policyEmergency = "emergency" // Largest and coldest below the hard floor
+)
+
+// guard decides which cache entries an eviction run must keep, it is
+// built once per run so that its snapshots are taken at most once.
+type guard struct {
+	n       *Notify
+	now     time.Time
+	trigger string
+	rules   *Rules // Snapshot of the rules file, if any
+	plan    *Plan  // Records the victims instead of deleting them
+
+	// emergency passes delete right away, bypassing the rate limit and
+	// the trash
+	emergency bool
+
+	procOpen map[string]struct{} // Filled lazily by the /proc scan
+
+	// deletions, see pace and close
+	deleter *diskutil.Deleter
+	ioprio  int
+	idle    bool
+
+	// summary of the run, see finish
+	start  time.Time
+	files  int
+	bytes  int64
+	kept   map[string]int
+	failed int   // Disks that couldn't be evicted and entries that couldn't be deleted
+	err    error // The first failure
+}
+
+func (n *Notify) newGuard(trigger string) *guard {
+	now := time.Now()
+	return &guard{
+		n:       n,
+		now:     now,
+		trigger: trigger,
+		rules:   n.rules.current(),
+		start:   now,
+		kept:    make(map[string]int),
+	}
+}
+
+// protect returns why entry must not be evicted, or "".
+func (g *guard) protect(entry diskutil.EntryInfo) string {
+	path := entry.Path
+	if g.n.pins.pinned(g.n.disk.PathToKey(path)) {
+		return reasonPinned
+	}
+	if g.rules != nil {
+		if g.rules.Keep(g.n.entry(entry), g.now) {
+			return reasonRule
+		}
+	}
+	o := g.n.openFiles
+	if o.busy(path, g.now) {
+		return reasonInUse
+	}
+	if g.n.minAge > 0 {
+		// a build uploads the CAS blobs of an action before the AC entry
+		// referencing them, evicting them in between breaks the result.
+		born, err := diskutil.GetBirthTime(path)
+		if err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("path", path).Error("Failed to get birth time")
+		}
+		if err == nil && g.now.Sub(born) < g.n.minAge {
+			return reasonTooYoung
+		}
+	}
+	if o.procScan {
+		if g.procOpen == nil {
+			g.procOpen = procOpenFiles()
+		}
+		if _, ok := g.procOpen[path]; ok {
+			return reasonInUse
+		}
+	}
+	return ""
+}
+
+// evict deletes entry, chosen by policy, unless g protects it, every
+// eviction path goes through it. It reports whether the entry was deleted,
+// and if it was protected, why. When g is planning the entry is added to
+// the plan instead, and in dry-run mode it is only logged.
+func (n *Notify) evict(g *guard, entry diskutil.EntryInfo, policy string) (deleted bool, reason string) {
+	if reason := g.protect(entry); reason != "" {
+		g.kept[reason]++
+		if g.plan != nil {
+			return false, reason
+		}
+		promMetrics.EvictionsSkipped.WithLabelValues(n.path, reason).Inc()
+		logrus.WithField("path", entry.Path).WithField("reason", reason).Debug("keep entry")
+		return false, reason
+	}
+	if g.plan != nil {
+		return g.plan.add(n, entry, policy, g.now), ""
+	}
+	if n.dryRun {
+		logrus.WithField("path", entry.Path).WithField("policy", policy).Debug("dry-run: would delete")
+		promMetrics.DryRunBytes.WithLabelValues(n.path, policy).Add(float64(entry.Size))
+		n.audit(g, entry, policy)
+		return true, ""
+	}
+	g.pace(entry.Size)
+	if err := n.remove(g, entry); err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Errorf("Error deleting entry at path: %v", entry.Path)
+			g.fail(err)
+		}
+		return false, ""
+	}
+	logrus.WithField("path", entry.Path).WithField("policy", policy).Debug("delete")
+	n.audit(g, entry, policy)
+	promMetrics.WorkspaceEvictedBytes.WithLabelValues(n.path, n.workspaceOf(entry.Path)).Add(float64(entry.Size))
+	return true, ""
+}
+
+// fail records a failure of g.
+func (g *guard) fail(err error) {
+	if g.failed == 0 {
+		g.err = err
+	}
+	g.failed++
+}
+
+// failure returns an error summing up the failures of g, nil if none.
+func (g *guard) failure() error {
+	if g.failed <= 1 {
+		return g.err
+	}
+	return fmt.Errorf("%w, and %d more failures", g.err, g.failed-1)
+}
+
+// remove deletes entry, or moves it to the trash if there is one outside
+// of emergencies.
+func (n *Notify) remove(g *guard, entry diskutil.EntryInfo) error {
+	if n.trash != nil && !g.emergency {
+		return n.moveToTrash(g, entry)
+	}
+	if g.deleter == nil {
+		g.deleter = n.disk.NewDeleter(maxOpenDirs)
+	}
+	return g.deleter.Delete(n.disk.PathToKey(entry.Path))
+}
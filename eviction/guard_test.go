@@ -0,0 +1,102 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFiles(t *testing.T) {
+	now := time.Now()
+	open := &inotify.Event{Mask: inotify.InOpen}
+	closed := &inotify.Event{Mask: inotify.InCloseNowrite}
+
+	o := newOpenFiles(true, false)
+	o.event(open, "a", now)
+	o.event(open, "a", now)
+	o.event(closed, "a", now)
+	require.True(t, o.busy("a", now))
+	o.event(closed, "a", now)
+	require.False(t, o.busy("a", now))
+
+	// closes of files opened before watching are ignored
+	o.event(closed, "b", now)
+	o.event(open, "b", now)
+	require.True(t, o.busy("b", now))
+	// a lost close does not keep the file forever
+	require.False(t, o.busy("b", now.Add(maxOpenAge+time.Second)))
+
+	// coalesced events cancel out
+	o.event(&inotify.Event{Mask: inotify.InOpen | inotify.InCloseWrite}, "c", now)
+	require.False(t, o.busy("c", now))
+
+	disabled := newOpenFiles(false, false)
+	disabled.event(open, "a", now)
+	require.False(t, disabled.busy("a", now))
+	require.Zero(t, disabled.mask())
+}
+
+func TestProcOpenFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.Contains(t, procOpenFiles(), path)
+	require.NoError(t, f.Close())
+	require.NotContains(t, procOpenFiles(), path)
+}
+
+func TestGuardMinAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	n := &Notify{disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), minAge: time.Hour}
+	require.Equal(t, reasonTooYoung, n.newGuard(triggerManual).protect(diskutil.EntryInfo{Path: path}))
+
+	g := n.newGuard(triggerManual)
+	g.now = g.now.Add(2 * time.Hour)
+	require.Empty(t, g.protect(diskutil.EntryInfo{Path: path}))
+}
+
+func TestPinRules(t *testing.T) {
+	var pins PinRules
+	require.NoError(t, pins.Set("release-*"))
+	require.NoError(t, pins.Set("glob:toolchains/cas/"))
+	require.NoError(t, pins.Set("prefix:ws/ac/ff"))
+	require.NoError(t, pins.Set("regex:^pr-[0-9]+/ac/"))
+	require.Error(t, pins.Set("glob:["))
+	require.Error(t, pins.Set("regex:("))
+	require.Error(t, pins.Set("suffix:x"))
+	require.Equal(t, "glob:release-* glob:toolchains/cas prefix:ws/ac/ff regex:^pr-[0-9]+/ac/", pins.String())
+
+	require.True(t, pins.pinned("release-1.2/cas/ab"))
+	require.True(t, pins.pinned("toolchains/cas/ab"))
+	require.True(t, pins.pinned("ws/ac/ff01"))
+	require.True(t, pins.pinned("pr-12/ac/ab"))
+	require.False(t, pins.pinned("pr-12/cas/ab"))
+	require.False(t, pins.pinned("toolchains/ac/ab"))
+	require.False(t, pins.pinned("toolchains"))
+	require.False(t, pins.pinned("ws/ac/0f"))
+
+	n := &Notify{disk: diskutil.NewCache("/cache"), openFiles: newOpenFiles(true, false), pins: pins}
+	require.Equal(t, reasonPinned, n.newGuard(triggerManual).protect(diskutil.EntryInfo{Path: "/cache/release-1/cas/ab"}))
+	require.Empty(t, n.newGuard(triggerManual).protect(diskutil.EntryInfo{Path: "/cache/ws/cas/ab"}))
+}
+
+func TestEvictOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "victim")
+	require.NoError(t, os.WriteFile(outside, []byte("entry"), 0644))
+	require.NoError(t, os.Symlink(filepath.Dir(outside), filepath.Join(dir, "ws")))
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false)}
+	g := n.newGuard(triggerManual)
+	for _, path := range []string{outside, filepath.Join(dir, "ws/victim")} {
+		deleted, _ := n.evict(g, diskutil.EntryInfo{Path: path, Size: 5}, policyExpelled)
+		require.False(t, deleted, path)
+	}
+	require.FileExists(t, outside)
+}
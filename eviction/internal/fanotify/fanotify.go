@@ -0,0 +1,36 @@
+package fanotify
+
+import (
+	"sync"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/hawkingrei/hoshino/eviction/internal/poller"
+	"golang.org/x/sys/unix"
+)
+
+// Watcher represents a fanotify instance marking whole filesystems.
+//
+// Unlike inotify.Watcher it needs no per-directory watches: a single
+// FAN_MARK_FILESYSTEM mark reports every event on the filesystem that
+// contains root, and events outside of root are filtered out. Filesystems
+// mounted beneath root need one more mark each, see AddWatch.
+type Watcher struct {
+	mu       sync.Mutex
+	fd       int                     // File descriptor (as returned by the fanotify_init() syscall)
+	poller   *poller.Poller          // Waits on fd, interrupted by Close
+	root     string                  // Only events beneath root are reported
+	mask     uint64                  // fanotify events of every mark
+	marks    map[unix.Fsid]string    // Marked filesystems (value: path the mark was added on)
+	dirs     map[string]string       // Cache of resolved directory handles (key: raw handle)
+	Error    chan error              // Errors are sent on this channel
+	Events   <-chan []*inotify.Event // Events are returned in batches on this channel
+	buffer   *inotify.Buffer         // Ring between readEvents and Events
+	done     chan struct{}           // Closed by Close to unblock the reader goroutine
+	exited   chan struct{}           // Closed when the reader goroutine returns
+	isClosed bool                    // Set to true when Close() is first called
+}
+
+// Stats returns the counters of events dropped or coalesced by the buffer.
+func (w *Watcher) Stats() inotify.BufferStats {
+	return w.buffer.Stats()
+}
@@ -0,0 +1,426 @@
+//go:build linux
+// +build linux
+
+/*
+Package fanotify implements a filesystem-wide watcher on top of the Linux
+fanotify API, reporting events in the same shape as package inotify.
+
+The watcher marks the filesystem with FAN_MARK_FILESYSTEM and asks the
+kernel for FAN_REPORT_DFID_NAME records, so it needs CAP_SYS_ADMIN to be
+created and CAP_DAC_READ_SEARCH to turn the reported directory handles
+back into paths.
+
+Example:
+
+	watcher, err := fanotify.NewWatcher("/mnt/cache", inotify.InOpen|inotify.InCreate)
+	if err != nil {
+	    log.Fatal(err)
+	}
+	for {
+	    select {
+	    case events := <-watcher.Events:
+	        for _, ev := range events {
+	            log.Println("event:", ev)
+	        }
+	    case err := <-watcher.Error:
+	        log.Println("error:", err)
+	    }
+	}
+*/
+package fanotify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/hawkingrei/hoshino/eviction/internal/poller"
+	"golang.org/x/sys/unix"
+)
+
+// maxCachedDirs bounds the handle to path cache, it is simply reset when full.
+const maxCachedDirs = 1 << 16
+
+// eventMasks maps the inotify flags understood by the watcher to the
+// corresponding fanotify mask bits.
+var eventMasks = []struct {
+	inotify  uint32
+	fanotify uint64
+}{
+	{inotify.InOpen, unix.FAN_OPEN},
+	{inotify.InCreate, unix.FAN_CREATE},
+	{inotify.InDelete, unix.FAN_DELETE},
+	{inotify.InCloseWrite, unix.FAN_CLOSE_WRITE},
+	{inotify.InCloseNowrite, unix.FAN_CLOSE_NOWRITE},
+	{inotify.InMovedFrom, unix.FAN_MOVED_FROM},
+	{inotify.InMovedTo, unix.FAN_MOVED_TO},
+	{inotify.InModify, unix.FAN_MODIFY},
+	{inotify.InAttrib, unix.FAN_ATTRIB},
+	{inotify.InIsdir, unix.FAN_ONDIR},
+	{inotify.InQOverflow, unix.FAN_Q_OVERFLOW},
+}
+
+// NewWatcher creates a fanotify instance reporting the events in flags
+// (interpreted as inotify flags) for everything beneath root.
+func NewWatcher(root string, flags uint32) (*Watcher, error) {
+	return NewBufferedWatcher(root, flags, inotify.DefaultBufferConfig)
+}
+
+// NewBufferedWatcher is like NewWatcher, with the event buffer configured by cfg.
+func NewBufferedWatcher(root string, flags uint32, cfg inotify.BufferConfig) (*Watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_LARGEFILE)
+	if err != nil {
+		return nil, os.NewSyscallError("fanotify_init", err)
+	}
+	poller, err := poller.New(fd, unix.EPOLLIN)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	buffer := inotify.NewBuffer(cfg)
+	w := &Watcher{
+		fd:     fd,
+		poller: poller,
+		root:   root,
+		mask:   toFanotify(flags),
+		marks:  make(map[unix.Fsid]string),
+		dirs:   make(map[string]string),
+		Events: buffer.C(),
+		buffer: buffer,
+		Error:  make(chan error),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	if err := w.mark(root); err != nil {
+		poller.Close()
+		unix.Close(fd)
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// NewWatcherContext is like NewBufferedWatcher, the watcher is closed when
+// ctx is done.
+func NewWatcherContext(ctx context.Context, root string, flags uint32, cfg inotify.BufferConfig) (*Watcher, error) {
+	w, err := NewBufferedWatcher(root, flags, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Close()
+		case <-w.exited:
+		}
+	}()
+	return w, nil
+}
+
+// AddWatch makes sure the filesystem containing path is marked, directories
+// on an already marked filesystem need no further watch. The flags given to
+// NewWatcher apply to every filesystem.
+func (w *Watcher) AddWatch(path string, flags uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return errors.New("fanotify instance already closed")
+	}
+	return w.mark(path)
+}
+
+// RemoveWatches removes the marks added for filesystems mounted on path or
+// beneath it.
+func (w *Watcher) RemoveWatches(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for fsid, point := range w.marks {
+		if point != path && !strings.HasPrefix(point, path+"/") {
+			continue
+		}
+		// the mark is already gone if the filesystem was unmounted
+		unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_FILESYSTEM, w.mask, unix.AT_FDCWD, point)
+		delete(w.marks, fsid)
+	}
+}
+
+// mark adds a filesystem mark for the filesystem containing path, w.mu must be held.
+func (w *Watcher) mark(path string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	if _, ok := w.marks[stat.Fsid]; ok {
+		return nil
+	}
+	// FAN_EVENT_ON_CHILD is implied by filesystem marks.
+	err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, w.mask, unix.AT_FDCWD, path)
+	if err == unix.EINVAL && w.mask&unix.FAN_RENAME != 0 {
+		// FAN_RENAME needs Linux 5.17, fall back to unpaired moves.
+		w.mask = w.mask&^unix.FAN_RENAME | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO
+		err = unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, w.mask, unix.AT_FDCWD, path)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fanotify_mark", Path: path, Err: err}
+	}
+	w.marks[stat.Fsid] = path
+	return nil
+}
+
+// Close closes the fanotify instance.
+// It wakes up the reader goroutine and waits for it to quit, the mark is
+// dropped together with the fanotify instance.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.isClosed {
+		w.mu.Unlock()
+		<-w.exited
+		return nil
+	}
+	w.isClosed = true
+	w.mu.Unlock()
+
+	// Unblock the reader goroutine wherever it is waiting
+	close(w.done)
+	w.buffer.Close()
+	err := w.poller.Interrupt()
+	<-w.exited
+	return err
+}
+
+// sendError reports err unless the watcher is being closed.
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.Error <- err:
+	case <-w.done:
+	}
+}
+
+// readEvents waits for the fanotify file descriptor to become readable,
+// converts the received events into inotify.Event objects and queues them
+// for the Events channel, until Close interrupts it.
+func (w *Watcher) readEvents() {
+	defer close(w.exited)
+	defer close(w.Error)
+	defer w.buffer.Close()
+	defer unix.Close(w.fd)
+	defer w.poller.Close()
+
+	buf := make([]byte, 4096*unix.FAN_EVENT_METADATA_LEN)
+
+	for {
+		_, err := w.poller.Wait(-1)
+		if err == poller.ErrInterrupted {
+			return
+		}
+		if err != nil {
+			w.sendError(err)
+			continue
+		}
+		// Drain the non-blocking descriptor
+		for {
+			n, err := unix.Read(w.fd, buf)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				break
+			}
+			if err != nil {
+				w.sendError(os.NewSyscallError("read", err))
+				break
+			}
+			w.parse(buf[:n])
+		}
+	}
+}
+
+// parse converts the raw events in buf and queues them.
+func (w *Watcher) parse(buf []byte) {
+	for offset := 0; offset+unix.FAN_EVENT_METADATA_LEN <= len(buf); {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+		if meta.Event_len < unix.FAN_EVENT_METADATA_LEN || offset+int(meta.Event_len) > len(buf) {
+			w.sendError(errors.New("fanotify: short read in readEvents()"))
+			return
+		}
+		event, err := w.convert(meta, buf[offset+int(meta.Metadata_len):offset+int(meta.Event_len)])
+		if err != nil {
+			w.sendError(err)
+		} else if event != nil {
+			w.buffer.Put(event)
+		}
+		if meta.Fd >= 0 {
+			unix.Close(int(meta.Fd))
+		}
+		offset += int(meta.Event_len)
+	}
+}
+
+// convert turns one fanotify event into an inotify.Event, it returns a nil
+// event for events outside of root.
+func (w *Watcher) convert(meta *unix.FanotifyEventMetadata, info []byte) (*inotify.Event, error) {
+	event := &inotify.Event{Mask: toInotify(meta.Mask), Pid: meta.Pid}
+	if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+		return event, nil
+	}
+	if meta.Mask&unix.FAN_ONDIR != 0 && meta.Mask&(unix.FAN_MOVE|unix.FAN_RENAME|unix.FAN_DELETE) != 0 {
+		// cached directory paths may be stale now
+		w.dirs = make(map[string]string)
+	}
+	var name, oldName, newName string
+	for len(info) >= 4 {
+		infoType, infoLen := info[0], int(*(*uint16)(unsafe.Pointer(&info[2])))
+		if infoLen < 4 || infoLen > len(info) {
+			return nil, errors.New("fanotify: malformed info record")
+		}
+		switch infoType {
+		case unix.FAN_EVENT_INFO_TYPE_DFID_NAME, unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME, unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			path, err := w.resolve(info[:infoLen])
+			if err != nil {
+				return nil, err
+			}
+			if !w.beneathRoot(path) {
+				path = ""
+			}
+			switch infoType {
+			case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+				oldName = path
+			case unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+				newName = path
+			default:
+				name = path
+			}
+		}
+		info = info[infoLen:]
+	}
+	if meta.Mask&unix.FAN_RENAME != 0 {
+		// Only report the half of the rename that is beneath root when the
+		// file crossed its boundary.
+		switch {
+		case oldName != "" && newName != "":
+			event.Mask |= inotify.InRename
+			event.Name, event.OldName = newName, oldName
+		case oldName != "":
+			event.Mask |= inotify.InMovedFrom
+			event.Name = oldName
+		case newName != "":
+			event.Mask |= inotify.InMovedTo
+			event.Name = newName
+		default:
+			return nil, nil
+		}
+		return event, nil
+	}
+	if name == "" {
+		return nil, nil
+	}
+	event.Name = name
+	return event, nil
+}
+
+// beneathRoot reports whether path is root or below it.
+func (w *Watcher) beneathRoot(path string) bool {
+	return path == w.root || strings.HasPrefix(path, w.root+"/")
+}
+
+// resolve turns a FAN_EVENT_INFO_TYPE_DFID_NAME record into a path.
+//
+// The record is laid out as the info header, the filesystem id, a
+// struct file_handle of the parent directory and the NUL terminated name.
+func (w *Watcher) resolve(record []byte) (string, error) {
+	const handleOffset = 4 + 8
+	if len(record) < handleOffset+8 {
+		return "", errors.New("fanotify: short file handle")
+	}
+	fsid := *(*unix.Fsid)(unsafe.Pointer(&record[4]))
+	handleBytes := int(*(*uint32)(unsafe.Pointer(&record[handleOffset])))
+	handleType := *(*int32)(unsafe.Pointer(&record[handleOffset+4]))
+	nameOffset := handleOffset + 8 + handleBytes
+	if nameOffset > len(record) {
+		return "", errors.New("fanotify: short file handle")
+	}
+	handle := record[handleOffset+8 : nameOffset]
+	name := record[nameOffset:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	dir, err := w.dirPath(fsid, handleType, handle)
+	if err != nil {
+		return "", err
+	}
+	if len(name) == 0 || string(name) == "." {
+		return dir, nil
+	}
+	return dir + "/" + string(name), nil
+}
+
+// dirPath returns the path of the directory identified by handle on the
+// filesystem fsid.
+//
+// open_by_handle_at needs a descriptor on that filesystem, it is opened
+// from the marked path for each lookup rather than kept open, which would
+// keep the filesystem from being unmounted.
+func (w *Watcher) dirPath(fsid unix.Fsid, handleType int32, handle []byte) (string, error) {
+	key := fmt.Sprintf("%d:%d:%d:%s", fsid.Val[0], fsid.Val[1], handleType, handle)
+	if dir, ok := w.dirs[key]; ok {
+		return dir, nil
+	}
+	w.mu.Lock()
+	point, ok := w.marks[fsid]
+	w.mu.Unlock()
+	if !ok {
+		return "", errors.New("fanotify: event on a filesystem that is not marked")
+	}
+	mountFd, err := unix.Open(point, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", &os.PathError{Op: "open", Path: point, Err: err}
+	}
+	defer unix.Close(mountFd)
+	fd, err := unix.OpenByHandleAt(mountFd, unix.NewFileHandle(handleType, handle), unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", os.NewSyscallError("open_by_handle_at", err)
+	}
+	defer unix.Close(fd)
+	dir, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", err
+	}
+	if len(w.dirs) >= maxCachedDirs {
+		w.dirs = make(map[string]string)
+	}
+	w.dirs[key] = dir
+	return dir, nil
+}
+
+func toFanotify(flags uint32) uint64 {
+	var mask uint64
+	for _, m := range eventMasks {
+		if flags&m.inotify == m.inotify {
+			mask |= m.fanotify
+		}
+	}
+	if flags&inotify.InMove == inotify.InMove {
+		// FAN_RENAME reports both names at once, like a paired InRename
+		mask = mask&^unix.FAN_MOVE | unix.FAN_RENAME
+	}
+	return mask &^ unix.FAN_Q_OVERFLOW
+}
+
+func toInotify(mask uint64) uint32 {
+	var flags uint32
+	for _, m := range eventMasks {
+		if mask&m.fanotify == m.fanotify {
+			flags |= m.inotify
+		}
+	}
+	return flags
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"golang.org/x/sys/unix"
+)
+
+func TestFanotifyEvents(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewWatcher(dir, inotify.InOpen|inotify.InCreate|inotify.InIsdir)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		t.Skipf("fanotify is not available: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %s", err)
+	}
+	defer watcher.Close()
+	go func() {
+		for err := range watcher.Error {
+			t.Logf("error received: %s", err)
+		}
+	}()
+
+	testFile := filepath.Join(dir, "TestFanotifyEvents.testfile")
+	f, err := os.OpenFile(testFile, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("creating test file: %s", err)
+	}
+	f.Close()
+
+	timeout := time.After(time.Second)
+	for created := false; !created; {
+		select {
+		case events := <-watcher.Events:
+			for _, event := range events {
+				t.Logf("event received: %s", event)
+				created = created || event.Name == testFile && event.HasEvent(inotify.InCreate)
+			}
+		case <-timeout:
+			t.Fatal("create event hasn't been received after 1 second")
+		}
+	}
+}
+
+func TestFanotifyRename(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewWatcher(dir, inotify.InMove)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		t.Skipf("fanotify is not available: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %s", err)
+	}
+	defer watcher.Close()
+
+	tmp, final := filepath.Join(dir, "tmp"), filepath.Join(dir, "final")
+	if err := os.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+
+	select {
+	case events := <-watcher.Events:
+		event := events[0]
+		if !event.HasEvent(inotify.InRename) || event.OldName != tmp || event.Name != final {
+			t.Fatalf("unexpected event received: %s", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rename event hasn't been received after 1 second")
+	}
+}
@@ -22,11 +22,10 @@ type HeavyKeeper struct {
 	lookupTable []float64
 	minCount    uint32
 
-	r        *rand.Rand
-	buckets  [][]bucket
-	minHeap  *minheap.Heap
-	expelled chan Item
-	total    uint64
+	r       *rand.Rand
+	buckets [][]bucket
+	minHeap *minheap.Heap
+	total   uint64
 }
 
 func NewHeavyKeeper(k, width, depth uint32, decay float64, min uint32) Topk {
@@ -44,7 +43,6 @@ func NewHeavyKeeper(k, width, depth uint32, decay float64, min uint32) Topk {
 		buckets:     arrays,
 		r:           rand.New(rand.NewSource(0)),
 		minHeap:     minheap.NewHeap(k),
-		expelled:    make(chan Item, 32),
 		minCount:    min,
 	}
 	for i := 0; i < LOOKUP_TABLE; i++ {
@@ -53,10 +51,6 @@ func NewHeavyKeeper(k, width, depth uint32, decay float64, min uint32) Topk {
 	return topk
 }
 
-func (topk *HeavyKeeper) Expelled() <-chan Item {
-	return topk.expelled
-}
-
 func (topk *HeavyKeeper) List() []Item {
 	items := topk.minHeap.Sorted()
 	res := make([]Item, 0, len(items))
@@ -128,18 +122,25 @@ func (topk *HeavyKeeper) Add(key string, incr uint32) (string, bool) {
 	var exp string
 	expelled := topk.minHeap.Add(&minheap.Node{Key: key, Count: maxCount})
 	if expelled != nil {
-		topk.expell(Item{Key: expelled.Key, Count: expelled.Count})
 		exp = expelled.Key
 	}
 
 	return exp, true
 }
 
-func (topk *HeavyKeeper) expell(item Item) {
-	select {
-	case topk.expelled <- item:
-	default:
+// Query estimates the count of key, it is 0 for keys that lost all their
+// buckets to heavier ones.
+func (topk *HeavyKeeper) Query(key string) uint32 {
+	keyBytes := []byte(key)
+	itemFingerprint := murmur3.Sum32(keyBytes)
+	var maxCount uint32
+	for i, row := range topk.buckets {
+		bucketNumber := murmur3.SeedSum32(uint32(i), keyBytes) % topk.width
+		if row[bucketNumber].fingerprint == itemFingerprint {
+			maxCount = max(maxCount, row[bucketNumber].count)
+		}
 	}
+	return maxCount
 }
 
 type bucket struct {
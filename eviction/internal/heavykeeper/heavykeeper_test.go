@@ -32,6 +32,17 @@ func TestTopkList(t *testing.T) {
 	}
 }
 
+func TestQuery(t *testing.T) {
+	topk := NewHeavyKeeper(2, 1000, 5, 0.925, 0)
+	for i := 0; i < 5; i++ {
+		topk.Add("a", 2)
+	}
+	topk.Add("b", 1)
+	assert.Equal(t, uint32(10), topk.Query("a"))
+	assert.Equal(t, uint32(1), topk.Query("b"))
+	assert.Equal(t, uint32(0), topk.Query("c"))
+}
+
 func BenchmarkAdd(b *testing.B) {
 	zipf := rand.NewZipf(rand.New(rand.NewSource(time.Now().Unix())), 2, 2, 1000)
 	var data []string = make([]string, 1000)
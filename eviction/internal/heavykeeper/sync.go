@@ -0,0 +1,38 @@
+package heavykeeper
+
+import "sync"
+
+// syncTopk serializes the calls to a Topk.
+type syncTopk struct {
+	mu   sync.Mutex
+	topk Topk
+}
+
+// NewSync makes topk safe for concurrent use.
+func NewSync(topk Topk) Topk {
+	return &syncTopk{topk: topk}
+}
+
+func (s *syncTopk) Add(item string, incr uint32) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topk.Add(item, incr)
+}
+
+func (s *syncTopk) Query(item string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topk.Query(item)
+}
+
+func (s *syncTopk) List() []Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topk.List()
+}
+
+func (s *syncTopk) Fading() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topk.Fading()
+}
@@ -8,11 +8,12 @@ type Item struct {
 
 // Topk algorithm interface.
 type Topk interface {
-	// Add item and return if item is in the topk.
+	// Add item and return if item is in the topk, with the item it
+	// expelled from the topk if any.
 	Add(item string, incr uint32) (string, bool)
+	// Query estimates the count of an item, in the topk or not.
+	Query(item string) uint32
 	// List all topk items.
 	List() []Item
-	// Expelled watch at the expelled items.
-	Expelled() <-chan Item
 	Fading()
 }
@@ -0,0 +1,228 @@
+package inotify
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what a Buffer does with a new event when it is full.
+type OverflowPolicy int
+
+const (
+	// Block makes the reader wait until the consumer makes room.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest queued event to make room.
+	DropOldest
+	// Coalesce merges the new event into a queued event for the same name
+	// once the ring is full, the new event is dropped if there is none.
+	// Renames are never merged.
+	Coalesce
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	Block:      "block",
+	DropOldest: "drop-oldest",
+	Coalesce:   "coalesce",
+}
+
+// String implements flag.Value.
+func (p *OverflowPolicy) String() string {
+	if p == nil {
+		return overflowPolicyNames[Block]
+	}
+	return overflowPolicyNames[*p]
+}
+
+// Set implements flag.Value.
+func (p *OverflowPolicy) Set(s string) error {
+	for policy, name := range overflowPolicyNames {
+		if name == s {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// BufferConfig configures the event buffer of a watcher.
+type BufferConfig struct {
+	Size      int            // Number of events the ring can hold
+	BatchSize int            // Maximum number of events delivered at once
+	Policy    OverflowPolicy // What to do when the ring is full
+}
+
+// DefaultBufferConfig is used by NewWatcher.
+var DefaultBufferConfig = BufferConfig{
+	Size:      1 << 16,
+	BatchSize: 512,
+	Policy:    Block,
+}
+
+// BufferStats are counters of events that never reached the consumer as-is.
+type BufferStats struct {
+	Dropped   uint64 // Events discarded because the ring was full
+	Coalesced uint64 // Events merged into an already queued event
+}
+
+// Buffer is a bounded ring of events sitting between a watcher's read loop
+// and its consumer, it delivers the queued events in batches so the read
+// loop does not stall on a slow consumer.
+type Buffer struct {
+	mu      sync.Mutex
+	notFull *sync.Cond
+	ring    []*Event
+	head    int               // Index of the oldest queued event
+	count   int               // Number of queued events
+	byName  map[string]*Event // Queued events by name, used to coalesce
+	stats   BufferStats
+	closed  bool
+
+	batchSize int
+	policy    OverflowPolicy
+	wakeup    chan struct{}
+	done      chan struct{}
+	out       chan []*Event
+}
+
+// NewBuffer creates a Buffer and starts delivering its events.
+func NewBuffer(cfg BufferConfig) *Buffer {
+	b := newBuffer(cfg)
+	go b.deliver()
+	return b
+}
+
+func newBuffer(cfg BufferConfig) *Buffer {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultBufferConfig.Size
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBufferConfig.BatchSize
+	}
+	b := &Buffer{
+		ring:      make([]*Event, cfg.Size),
+		byName:    make(map[string]*Event),
+		batchSize: cfg.BatchSize,
+		policy:    cfg.Policy,
+		wakeup:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		out:       make(chan []*Event),
+	}
+	b.notFull = sync.NewCond(&b.mu)
+	return b
+}
+
+// C returns the channel batches are delivered on, it is closed by Close.
+func (b *Buffer) C() <-chan []*Event {
+	return b.out
+}
+
+// Stats returns the drop counters of the buffer.
+func (b *Buffer) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Put queues an event, applying the overflow policy if the ring is full.
+func (b *Buffer) Put(event *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.count == len(b.ring) && !b.closed {
+		switch b.policy {
+		case DropOldest:
+			b.pop()
+			b.stats.Dropped++
+		case Coalesce:
+			if queued, ok := b.byName[event.Name]; ok && event.Name != "" && !event.HasEvent(InRename) {
+				queued.Mask |= event.Mask
+				b.stats.Coalesced++
+			} else {
+				b.stats.Dropped++
+			}
+			return
+		default:
+			b.notFull.Wait()
+		}
+	}
+	if b.closed {
+		return
+	}
+	b.ring[(b.head+b.count)%len(b.ring)] = event
+	b.count++
+	if b.policy == Coalesce && event.Name != "" {
+		if event.HasEvent(InRename) {
+			// later events must not be merged into the ones before the rename
+			delete(b.byName, event.Name)
+			delete(b.byName, event.OldName)
+		} else {
+			b.byName[event.Name] = event
+		}
+	}
+	select {
+	case b.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the delivery and closes the channel returned by C,
+// queued events that were not delivered yet are discarded.
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	b.notFull.Broadcast()
+	b.mu.Unlock()
+	close(b.done)
+}
+
+// pop removes the oldest queued event, b.mu must be held.
+func (b *Buffer) pop() *Event {
+	event := b.ring[b.head]
+	b.ring[b.head] = nil
+	b.head = (b.head + 1) % len(b.ring)
+	b.count--
+	if b.byName[event.Name] == event {
+		delete(b.byName, event.Name)
+	}
+	return event
+}
+
+// next takes up to batchSize queued events.
+func (b *Buffer) next() []*Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.count
+	if n > b.batchSize {
+		n = b.batchSize
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := make([]*Event, n)
+	for i := range batch {
+		batch[i] = b.pop()
+	}
+	b.notFull.Broadcast()
+	return batch
+}
+
+func (b *Buffer) deliver() {
+	defer close(b.out)
+	for {
+		select {
+		case <-b.wakeup:
+		case <-b.done:
+			return
+		}
+		for batch := b.next(); batch != nil; batch = b.next() {
+			select {
+			case b.out <- batch:
+			case <-b.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package inotify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func names(events []*Event) []string {
+	res := make([]string, 0, len(events))
+	for _, event := range events {
+		res = append(res, event.Name)
+	}
+	return res
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	b := newBuffer(BufferConfig{Size: 2, BatchSize: 8, Policy: DropOldest})
+	b.Put(&Event{Name: "a"})
+	b.Put(&Event{Name: "b"})
+	b.Put(&Event{Name: "c"})
+	require.Equal(t, []string{"b", "c"}, names(b.next()))
+	require.Equal(t, BufferStats{Dropped: 1}, b.Stats())
+	require.Nil(t, b.next())
+}
+
+func TestBufferCoalesce(t *testing.T) {
+	b := newBuffer(BufferConfig{Size: 2, BatchSize: 1, Policy: Coalesce})
+	b.Put(&Event{Name: "a", Mask: InCreate})
+	b.Put(&Event{Name: "b", Mask: InOpen})
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	b.Put(&Event{Name: "c", Mask: InOpen})
+	batch := b.next()
+	require.Equal(t, []string{"a"}, names(batch))
+	require.Equal(t, InCreate|InOpen, batch[0].Mask)
+	require.Equal(t, []string{"b"}, names(b.next()))
+	require.Equal(t, BufferStats{Dropped: 1, Coalesced: 1}, b.Stats())
+
+	// a was delivered, so it is queued again instead of being coalesced
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	require.Equal(t, []string{"a"}, names(b.next()))
+
+	// below capacity every event is queued
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	require.Equal(t, []string{"a"}, names(b.next()))
+	require.Equal(t, []string{"a"}, names(b.next()))
+
+	// renames are never merged, nor merged into
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	b.Put(&Event{Name: "a", OldName: "x", Mask: InRename})
+	b.Put(&Event{Name: "a", Mask: InOpen})
+	batch = b.next()
+	require.Equal(t, InOpen, batch[0].Mask)
+	batch = b.next()
+	require.Equal(t, InRename, batch[0].Mask)
+	require.Equal(t, "x", batch[0].OldName)
+	require.Equal(t, BufferStats{Dropped: 2, Coalesced: 1}, b.Stats())
+}
+
+func TestBufferBlock(t *testing.T) {
+	b := NewBuffer(BufferConfig{Size: 1, BatchSize: 4, Policy: Block})
+	go func() {
+		for i := 0; i < 16; i++ {
+			b.Put(&Event{Name: "a"})
+		}
+	}()
+	received := 0
+	for batch := range b.C() {
+		received += len(batch)
+		if received == 16 {
+			break
+		}
+	}
+	b.Close()
+	require.Equal(t, 16, received)
+	require.Equal(t, BufferStats{}, b.Stats())
+}
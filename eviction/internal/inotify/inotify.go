@@ -2,19 +2,30 @@ package inotify
 
 import (
 	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/poller"
 )
 
 // Event represents a notification
 type Event struct {
-	Mask   uint32 // Mask of events
-	Cookie uint32 // Unique cookie associating related events (for rename(2))
-	Name   string // File name (optional)
+	Mask    uint32 // Mask of events
+	Cookie  uint32 // Unique cookie associating related events (for rename(2))
+	Name    string // File name (optional)
+	OldName string // Name before the rename, only set for InRename events
+	Pid     int32  // Process that caused the event, 0 when unknown (always for inotify)
 }
 
 func (e *Event) HasEvent(h uint32) bool {
 	return e.Mask&h == h
 }
 
+// move is an IN_MOVED_FROM event waiting for its IN_MOVED_TO.
+type move struct {
+	event *Event
+	at    time.Time // When it was read
+}
+
 type watch struct {
 	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
 	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
@@ -24,10 +35,19 @@ type watch struct {
 type Watcher struct {
 	mu       sync.Mutex
 	fd       int               // File descriptor (as returned by the inotify_init() syscall)
+	poller   *poller.Poller    // Waits on fd, interrupted by Close
 	watches  map[string]*watch // Map of inotify watches (key: path)
 	paths    map[int]string    // Map of watched paths (key: watch descriptor)
+	moves    map[uint32]move   // IN_MOVED_FROM events waiting for their IN_MOVED_TO (key: cookie)
 	Error    chan error        // Errors are sent on this channel
-	Event    chan *Event       // Events are returned on this channel
-	done     chan bool         // Channel for sending a "quit message" to the reader goroutine
+	Events   <-chan []*Event   // Events are returned in batches on this channel
+	buffer   *Buffer           // Ring between readEvents and Events
+	done     chan struct{}     // Closed by Close to unblock the reader goroutine
+	exited   chan struct{}     // Closed when the reader goroutine returns
 	isClosed bool              // Set to true when Close() is first called
 }
+
+// Stats returns the counters of events dropped or coalesced by the buffer.
+func (w *Watcher) Stats() BufferStats {
+	return w.buffer.Stats()
+}
@@ -20,8 +20,10 @@ Example:
 	}
 	for {
 	    select {
-	    case ev := <-watcher.Event:
-	        log.Println("event:", ev)
+	    case events := <-watcher.Events:
+	        for _, ev := range events {
+	            log.Println("event:", ev)
+	        }
 	    case err := <-watcher.Error:
 	        log.Println("error:", err)
 	    }
@@ -30,54 +32,98 @@ Example:
 package inotify // import "k8s.io/utils/inotify"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/poller"
+	"golang.org/x/sys/unix"
 )
 
 // NewWatcher creates and returns a new inotify instance using inotify_init(2)
 func NewWatcher() (*Watcher, error) {
-	fd, errno := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	return NewBufferedWatcher(DefaultBufferConfig)
+}
+
+// NewBufferedWatcher is like NewWatcher, with the event buffer configured by cfg.
+func NewBufferedWatcher(cfg BufferConfig) (*Watcher, error) {
+	fd, errno := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
 	if fd == -1 {
 		return nil, os.NewSyscallError("inotify_init", errno)
 	}
+	poller, err := poller.New(fd, unix.EPOLLIN)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	buffer := NewBuffer(cfg)
 	w := &Watcher{
 		fd:      fd,
+		poller:  poller,
 		watches: make(map[string]*watch),
 		paths:   make(map[int]string),
-		Event:   make(chan *Event),
+		moves:   make(map[uint32]move),
+		Events:  buffer.C(),
+		buffer:  buffer,
 		Error:   make(chan error),
-		done:    make(chan bool, 1),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
 	}
 
 	go w.readEvents()
 	return w, nil
 }
 
+// NewWatcherContext is like NewBufferedWatcher, the watcher is closed when
+// ctx is done.
+func NewWatcherContext(ctx context.Context, cfg BufferConfig) (*Watcher, error) {
+	w, err := NewBufferedWatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Close()
+		case <-w.exited:
+		}
+	}()
+	return w, nil
+}
+
 // Close closes an inotify watcher instance
-// It sends a message to the reader goroutine to quit and removes all watches
-// associated with the inotify instance
+// It wakes up the reader goroutine, waits for it to quit and forgets all
+// watches, which the kernel drops together with the inotify instance.
 func (w *Watcher) Close() error {
+	w.mu.Lock()
 	if w.isClosed {
+		w.mu.Unlock()
+		<-w.exited
 		return nil
 	}
 	w.isClosed = true
+	w.watches = make(map[string]*watch)
+	w.paths = make(map[int]string)
+	w.mu.Unlock()
 
-	// Send "quit" message to the reader goroutine
-	w.done <- true
-	for path := range w.watches {
-		w.RemoveWatch(path)
-	}
-
-	return nil
+	// Unblock the reader goroutine wherever it is waiting
+	close(w.done)
+	w.buffer.Close()
+	err := w.poller.Interrupt()
+	<-w.exited
+	return err
 }
 
 // AddWatch adds path to the watched file set.
 // The flags are interpreted as described in inotify_add_watch(2).
 func (w *Watcher) AddWatch(path string, flags uint32) error {
+	w.mu.Lock() // synchronize with Close and the readEvents goroutine
+	defer w.mu.Unlock()
 	if w.isClosed {
 		return errors.New("inotify instance already closed")
 	}
@@ -88,11 +134,8 @@ func (w *Watcher) AddWatch(path string, flags uint32) error {
 		flags |= syscall.IN_MASK_ADD
 	}
 
-	w.mu.Lock() // synchronize with readEvents goroutine
-
 	wd, err := syscall.InotifyAddWatch(w.fd, path, flags)
 	if err != nil {
-		w.mu.Unlock()
 		return &os.PathError{
 			Op:   "inotify_add_watch",
 			Path: path,
@@ -103,8 +146,13 @@ func (w *Watcher) AddWatch(path string, flags uint32) error {
 	if !found {
 		w.watches[path] = &watch{wd: uint32(wd), flags: flags}
 		w.paths[wd] = path
+	} else if watchEntry.wd != uint32(wd) {
+		// path is a different directory now, e.g. a filesystem was
+		// mounted over it, events of the hidden one are dropped.
+		delete(w.paths, int(watchEntry.wd))
+		watchEntry.wd = uint32(wd)
+		w.paths[wd] = path
 	}
-	w.mu.Unlock()
 	return nil
 }
 
@@ -115,6 +163,11 @@ func (w *Watcher) Watch(path string) error {
 
 // RemoveWatch removes path from the watched file set.
 func (w *Watcher) RemoveWatch(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return errors.New("inotify instance already closed")
+	}
 	watch, ok := w.watches[path]
 	if !ok {
 		return fmt.Errorf("can't remove non-existent inotify watch for: %s", path)
@@ -128,79 +181,185 @@ func (w *Watcher) RemoveWatch(path string) error {
 		}
 	}
 	delete(w.watches, path)
-	// Locking here to protect the read from paths in readEvents.
-	w.mu.Lock()
 	delete(w.paths, int(watch.wd))
-	w.mu.Unlock()
 	return nil
 }
 
-// readEvents reads from the inotify file descriptor, converts the
-// received events into Event objects and sends them via the Event channel
+// sendError reports err unless the watcher is being closed.
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.Error <- err:
+	case <-w.done:
+	}
+}
+
+// readEvents waits for the inotify file descriptor to become readable,
+// converts the received events into Event objects and queues them for the
+// Events channel, until Close interrupts it.
 func (w *Watcher) readEvents() {
+	defer close(w.exited)
+	defer close(w.Error)
+	defer w.buffer.Close()
+	defer syscall.Close(w.fd)
+	defer w.poller.Close()
+
 	var buf [syscall.SizeofInotifyEvent * 4096]byte
 
 	for {
-		n, err := syscall.Read(w.fd, buf[:])
-		// See if there is a message on the "done" channel
-		var done bool
-		select {
-		case done = <-w.done:
-		default:
+		timeout := -1
+		if len(w.moves) > 0 {
+			timeout = int(MoveWindow / time.Millisecond)
 		}
-
-		// If EOF or a "done" message is received
-		if n == 0 || done {
-			// The syscall.Close can be slow.  Close
-			// w.Event first.
-			close(w.Event)
-			err := syscall.Close(w.fd)
-			if err != nil {
-				w.Error <- os.NewSyscallError("close", err)
-			}
-			close(w.Error)
+		ready, err := w.poller.Wait(timeout)
+		if err == poller.ErrInterrupted {
 			return
 		}
-		if n < 0 {
-			w.Error <- os.NewSyscallError("read", err)
+		if err != nil {
+			w.sendError(err)
 			continue
 		}
-		if n < syscall.SizeofInotifyEvent {
-			w.Error <- errors.New("inotify: short read in readEvents()")
+		if !ready {
+			// The other half of the pending renames did not show up in
+			// time, the files were moved out of (or into) unwatched paths.
+			w.flushMoves(time.Now())
 			continue
 		}
+		// Drain the non-blocking descriptor
+		for {
+			n, err := syscall.Read(w.fd, buf[:])
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				break
+			}
+			if err != nil {
+				w.sendError(os.NewSyscallError("read", err))
+				break
+			}
+			if n < syscall.SizeofInotifyEvent {
+				w.sendError(errors.New("inotify: short read in readEvents()"))
+				break
+			}
+			w.parse(buf[:n])
+		}
+		// A busy descriptor never lets the wait time out, expire the
+		// pending renames here too.
+		w.flushMoves(time.Now().Add(-MoveWindow))
+	}
+}
 
-		var offset uint32
-		// We don't know how many events we just read into the buffer
-		// While the offset points to at least one whole event...
-		for offset <= uint32(n-syscall.SizeofInotifyEvent) {
-			// Point "raw" to the event in the buffer
-			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
-			event := new(Event)
-			event.Mask = uint32(raw.Mask)
-			event.Cookie = uint32(raw.Cookie)
-			nameLen := uint32(raw.Len)
-			// If the event happened to the watched directory or the watched file, the kernel
-			// doesn't append the filename to the event, but we would like to always fill the
-			// the "Name" field with a valid filename. We retrieve the path of the watch from
-			// the "paths" map.
-			w.mu.Lock()
-			name, ok := w.paths[int(raw.Wd)]
-			w.mu.Unlock()
-			if ok {
-				event.Name = name
-				if nameLen > 0 {
-					// Point "bytes" at the first byte of the filename
-					bytes := (*[syscall.PathMax]byte)(unsafe.Pointer(&buf[offset+syscall.SizeofInotifyEvent]))
-					// The filename is padded with NUL bytes. TrimRight() gets rid of those.
-					event.Name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
-				}
-				// Send the event on the events channel
-				w.Event <- event
+// parse converts the raw events in buf and queues them.
+func (w *Watcher) parse(buf []byte) {
+	var offset uint32
+	// We don't know how many events we just read into the buffer
+	// While the offset points to at least one whole event...
+	for offset <= uint32(len(buf)-syscall.SizeofInotifyEvent) {
+		// Point "raw" to the event in the buffer
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		event := new(Event)
+		event.Mask = uint32(raw.Mask)
+		event.Cookie = uint32(raw.Cookie)
+		nameLen := uint32(raw.Len)
+		// If the event happened to the watched directory or the watched file, the kernel
+		// doesn't append the filename to the event, but we would like to always fill the
+		// the "Name" field with a valid filename. We retrieve the path of the watch from
+		// the "paths" map.
+		w.mu.Lock()
+		name, ok := w.paths[int(raw.Wd)]
+		if ok && event.Mask&InIgnored != 0 {
+			// The kernel dropped the watch: the path was deleted or its
+			// filesystem unmounted.
+			delete(w.paths, int(raw.Wd))
+			if watch, found := w.watches[name]; found && watch.wd == uint32(raw.Wd) {
+				delete(w.watches, name)
 			}
-			// Move to the next event in the buffer
-			offset += syscall.SizeofInotifyEvent + nameLen
 		}
+		w.mu.Unlock()
+		if ok {
+			event.Name = name
+			if nameLen > 0 {
+				// Point "bytes" at the first byte of the filename
+				bytes := (*[syscall.PathMax]byte)(unsafe.Pointer(&buf[offset+syscall.SizeofInotifyEvent]))
+				// The filename is padded with NUL bytes. TrimRight() gets rid of those.
+				event.Name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+			}
+			// Queue the event for the events channel
+			w.emit(event)
+		}
+		// Move to the next event in the buffer
+		offset += syscall.SizeofInotifyEvent + nameLen
+	}
+}
+
+// emit queues event, pairing IN_MOVED_FROM and IN_MOVED_TO events that
+// share a cookie into a single InRename event.
+func (w *Watcher) emit(event *Event) {
+	switch {
+	case event.Mask&InMovedFrom != 0 && event.Cookie != 0:
+		w.moves[event.Cookie] = move{event: event, at: time.Now()}
+		return
+	case event.Mask&InMovedTo != 0 && event.Cookie != 0:
+		from, ok := w.moves[event.Cookie]
+		if !ok {
+			break
+		}
+		delete(w.moves, event.Cookie)
+		event = &Event{
+			Mask:    InRename | event.Mask&InIsdir,
+			Cookie:  event.Cookie,
+			Name:    event.Name,
+			OldName: from.event.Name,
+		}
+		if event.Mask&InIsdir != 0 {
+			w.renameWatches(event.OldName, event.Name)
+		}
+	}
+	w.buffer.Put(event)
+}
+
+// flushMoves queues the IN_MOVED_FROM events read before deadline that were
+// never paired.
+func (w *Watcher) flushMoves(deadline time.Time) {
+	for cookie, m := range w.moves {
+		if !m.at.Before(deadline) {
+			continue
+		}
+		delete(w.moves, cookie)
+		event := m.event
+		if event.Mask&InIsdir != 0 {
+			// The directory left the watched tree, its watches would
+			// report events under a stale path.
+			w.RemoveWatches(event.Name)
+		}
+		w.buffer.Put(event)
+	}
+}
+
+// renameWatches moves the watches on oldPath and beneath it to newPath.
+func (w *Watcher) renameWatches(oldPath, newPath string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path, watch := range w.watches {
+		if path != oldPath && !strings.HasPrefix(path, oldPath+"/") {
+			continue
+		}
+		renamed := newPath + strings.TrimPrefix(path, oldPath)
+		delete(w.watches, path)
+		w.watches[renamed] = watch
+		w.paths[int(watch.wd)] = renamed
+	}
+}
+
+// RemoveWatches removes the watches on path and beneath it.
+func (w *Watcher) RemoveWatches(path string) {
+	w.mu.Lock()
+	var paths []string
+	for p := range w.watches {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			paths = append(paths, p)
+		}
+	}
+	w.mu.Unlock()
+	for _, p := range paths {
+		w.RemoveWatch(p)
 	}
 }
 
@@ -224,6 +383,9 @@ func (e *Event) String() string {
 		events = " == " + events[1:]
 	}
 
+	if e.OldName != "" {
+		return fmt.Sprintf("%q -> %q: %#x%s", e.OldName, e.Name, e.Mask, events)
+	}
 	return fmt.Sprintf("%q: %#x%s", e.Name, e.Mask, events)
 }
 
@@ -288,8 +450,17 @@ const (
 	InQOverflow uint32 = syscall.IN_Q_OVERFLOW
 	// InUnmount : Filesystem containing watched object was unmounted
 	InUnmount uint32 = syscall.IN_UNMOUNT
+
+	// Synthesized events, never reported by the kernel
+
+	// InRename : File was renamed within the watched tree, Event.OldName holds its previous name
+	InRename uint32 = 0x00010000
 )
 
+// MoveWindow is how long an IN_MOVED_FROM event waits for the matching
+// IN_MOVED_TO event before it is reported on its own.
+var MoveWindow = 50 * time.Millisecond
+
 var eventBits = []struct {
 	Value uint32
 	Name  string
@@ -312,4 +483,5 @@ var eventBits = []struct {
 	{InIgnored, "IN_IGNORED"},
 	{InQOverflow, "IN_Q_OVERFLOW"},
 	{InUnmount, "IN_UNMOUNT"},
+	{InRename, "IN_RENAME"},
 }
@@ -8,8 +8,10 @@
 package inotify
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -44,17 +46,19 @@ func TestInotifyEvents(t *testing.T) {
 	testFile := dir + "/TestInotifyEvents.testfile"
 
 	// Receive events on the event channel on a separate goroutine
-	eventstream := watcher.Event
+	eventstream := watcher.Events
 	var eventsReceived int32
 	done := make(chan bool)
 	go func() {
-		for event := range eventstream {
-			// Only count relevant events
-			if event.Name == testFile {
-				atomic.AddInt32(&eventsReceived, 1)
-				t.Logf("event received: %s", event)
-			} else {
-				t.Logf("unexpected event received: %s", event)
+		for events := range eventstream {
+			for _, event := range events {
+				// Only count relevant events
+				if event.Name == testFile {
+					atomic.AddInt32(&eventsReceived, 1)
+					t.Logf("event received: %s", event)
+				} else {
+					t.Logf("unexpected event received: %s", event)
+				}
 			}
 		}
 		done <- true
@@ -106,3 +110,115 @@ func TestInotifyClose(t *testing.T) {
 		t.Fatal("expected error on Watch() after Close(), got nil")
 	}
 }
+
+func TestInotifyContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher, err := NewWatcherContext(ctx, DefaultBufferConfig)
+	if err != nil {
+		t.Fatalf("NewWatcherContext failed: %s", err)
+	}
+	if err := watcher.Watch(t.TempDir()); err != nil {
+		t.Fatalf("Watch failed: %s", err)
+	}
+
+	// No event is pending, the reader goroutine is blocked waiting for one
+	cancel()
+	select {
+	case _, ok := <-watcher.Events:
+		if ok {
+			t.Fatal("unexpected event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event stream was not closed after 1 second")
+	}
+	if err := watcher.Watch(os.TempDir()); err == nil {
+		t.Fatal("expected error on Watch() after cancel, got nil")
+	}
+}
+
+func TestInotifyRename(t *testing.T) {
+	watcher, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %s", err)
+	}
+	defer watcher.Close()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %s", err)
+	}
+	for _, path := range []string{dir, dir + "/sub"} {
+		if err := watcher.AddWatch(path, InMovedFrom|InMovedTo); err != nil {
+			t.Fatalf("AddWatch failed: %s", err)
+		}
+	}
+
+	if err := os.WriteFile(dir+"/tmp", nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err := os.Rename(dir+"/tmp", dir+"/sub/final"); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+
+	select {
+	case events := <-watcher.Events:
+		if len(events) != 1 {
+			t.Fatalf("expected a single event, got %v", events)
+		}
+		event := events[0]
+		if !event.HasEvent(InRename) || event.OldName != dir+"/tmp" || event.Name != dir+"/sub/final" {
+			t.Fatalf("unexpected event received: %s", event)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("rename event hasn't been received after 1 second")
+	}
+}
+
+func TestInotifyMoveExpired(t *testing.T) {
+	watcher, err := NewWatcher()
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %s", err)
+	}
+	defer watcher.Close()
+
+	dir := t.TempDir()
+	if err := watcher.AddWatch(dir, InMovedFrom|InCreate); err != nil {
+		t.Fatalf("AddWatch failed: %s", err)
+	}
+	if err := os.WriteFile(dir+"/tmp", nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if err := os.Rename(dir+"/tmp", t.TempDir()+"/out"); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+
+	// Creates keep the descriptor busy, the wait never times out
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(MoveWindow / 5)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				os.WriteFile(dir+"/busy"+strconv.Itoa(i), nil, 0644)
+			}
+		}
+	}()
+
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case events := <-watcher.Events:
+			for _, event := range events {
+				if event.HasEvent(InMovedFrom) && event.Name == dir+"/tmp" {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("move event hasn't been received after 1 second")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+// Package poller waits for a non-blocking file descriptor to become ready
+// with epoll(7), while letting another goroutine interrupt the wait through
+// an eventfd(2).
+package poller
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrInterrupted is returned by Wait once Interrupt has been called.
+var ErrInterrupted = errors.New("poller: interrupted")
+
+// Poller waits on a single file descriptor.
+type Poller struct {
+	fd     int // Watched file descriptor, owned by the caller
+	epfd   int // File descriptor (as returned by the epoll_create1() syscall)
+	wakefd int // File descriptor (as returned by the eventfd() syscall)
+}
+
+// New creates a Poller waiting for events (EPOLLIN, EPOLLPRI...) on fd,
+// which must be non-blocking.
+func New(fd int, events uint32) (*Poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	wakefd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	p := &Poller{fd: fd, epfd: epfd, wakefd: wakefd}
+	for f, events := range map[int]uint32{fd: events, wakefd: unix.EPOLLIN} {
+		event := unix.EpollEvent{Events: events, Fd: int32(f)}
+		if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, f, &event); err != nil {
+			p.Close()
+			return nil, os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	return p, nil
+}
+
+// Wait blocks until the file descriptor is ready or msec milliseconds
+// passed, a negative msec waits forever. It returns whether the file
+// descriptor is ready, or ErrInterrupted after Interrupt was called.
+func (p *Poller) Wait(msec int) (bool, error) {
+	events := make([]unix.EpollEvent, 2)
+	for {
+		n, err := unix.EpollWait(p.epfd, events, msec)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, os.NewSyscallError("epoll_wait", err)
+		}
+		ready := false
+		for _, event := range events[:n] {
+			if int(event.Fd) == p.wakefd {
+				return false, ErrInterrupted
+			}
+			ready = ready || int(event.Fd) == p.fd
+		}
+		return ready, nil
+	}
+}
+
+// Interrupt wakes up Wait, and makes every later call return ErrInterrupted.
+func (p *Poller) Interrupt() error {
+	var buf [8]byte
+	buf[0] = 1
+	_, err := unix.Write(p.wakefd, buf[:])
+	if err != nil && err != unix.EAGAIN {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+// Close releases the epoll instance and the eventfd, but not the watched
+// file descriptor.
+func (p *Poller) Close() error {
+	err := unix.Close(p.wakefd)
+	if cerr := unix.Close(p.epfd); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package eviction
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/poller"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// mountRescanInterval bounds how long a missed mountinfo change goes unnoticed.
+const mountRescanInterval = time.Minute
+
+// mount is a filesystem mounted on or beneath the listen dir, usually one
+// local PV holding a share of the cache.
+type mount struct {
+	point  string
+	dev    uint64 // st_dev of the files on the filesystem
+	cancel context.CancelFunc
+}
+
+// discover keeps n.mounts in sync with /proc/self/mountinfo until ctx is
+// done: new mounts get watched and their own eviction loop, mounts that went
+// away are detached.
+func (n *Notify) discover(ctx context.Context) {
+	logger := logrus.WithField("sync-loop", "discover").WithField("listen-dir", n.transfer.listenDir)
+	// os.Open would register the descriptor with the runtime poller, which
+	// then consumes the mount table changes before our poller sees them.
+	fd, err := unix.Open("/proc/self/mountinfo", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		logger.WithError(os.NewSyscallError("open", err)).Error("Failed to open mountinfo")
+		return
+	}
+	f := os.NewFile(uintptr(fd), "/proc/self/mountinfo")
+	defer f.Close()
+	// mountinfo reports changes of the mount table as EPOLLPRI
+	p, err := poller.New(fd, unix.EPOLLPRI)
+	if err != nil {
+		logger.WithError(err).Error("Failed to poll mountinfo")
+		return
+	}
+	defer p.Close()
+	go func() {
+		<-ctx.Done()
+		p.Interrupt()
+	}()
+
+	for {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			logger.WithError(err).Error("Failed to rewind mountinfo")
+		} else if points, err := parseMountinfo(f, n.transfer.listenDir); err != nil {
+			logger.WithError(err).Error("Failed to parse mountinfo")
+		} else {
+			n.syncMounts(ctx, points)
+		}
+		_, err := p.Wait(int(mountRescanInterval / time.Millisecond))
+		if err == poller.ErrInterrupted {
+			n.mountsMu.Lock()
+			for _, m := range n.mounts {
+				n.detach(m)
+			}
+			n.mountsMu.Unlock()
+			return
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to wait for mountinfo")
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// syncMounts attaches the mounts in points that are not known yet and
+// detaches the known mounts missing from it.
+func (n *Notify) syncMounts(ctx context.Context, points map[string]uint64) {
+	n.mountsMu.Lock()
+	defer n.mountsMu.Unlock()
+	for point, m := range n.mounts {
+		if dev, ok := points[point]; !ok || dev != m.dev {
+			n.detach(m)
+		}
+	}
+	for point, dev := range points {
+		if _, ok := n.mounts[point]; !ok {
+			n.attach(ctx, point, dev)
+		}
+	}
+}
+
+// unmounted detaches the mount containing path, it is called for the
+// IN_UNMOUNT events of its watches.
+func (n *Notify) unmounted(path string) {
+	n.mountsMu.Lock()
+	defer n.mountsMu.Unlock()
+	for point, m := range n.mounts {
+		if path == point || strings.HasPrefix(path, point+"/") {
+			n.detach(m)
+		}
+	}
+}
+
+// attach starts watching the mount on point, n.mountsMu must be held.
+func (n *Notify) attach(ctx context.Context, point string, dev uint64) {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &mount{point: point, dev: dev, cancel: cancel}
+	n.mounts[point] = m
+	if err := n.watcher.AddWatch(point, n.mask()); err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to watch mount")
+	}
+	n.watchTree(point)
+	go n.mountLoop(ctx, m)
+	logrus.WithField("mount", point).Info("Attached disk")
+}
+
+// detach stops watching the mount m, n.mountsMu must be held.
+func (n *Notify) detach(m *mount) {
+	m.cancel()
+	n.watcher.RemoveWatches(m.point)
+	delete(n.mounts, m.point)
+	forgetDiskUsage(m.point)
+	logrus.WithField("mount", m.point).Info("Detached disk")
+}
+
+// mountLoop checks the disk usage of m every disk check interval and asks
+// the eviction loop to evict entries from it when it runs low on space.
+func (n *Notify) mountLoop(ctx context.Context, m *mount) {
+	ticker := time.NewTicker(n.diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			blocksFree, _, _, err := n.diskUsage(m.point)
+			if err != nil {
+				logrus.WithError(err).WithField("mount", m.point).Error("Failed to get disk usage!")
+				continue
+			}
+			if blocksFree >= n.minPercentBlocksFree {
+				continue
+			}
+			select {
+			case n.pressure <- m:
+			default:
+				// an eviction is already pending
+			}
+		}
+	}
+}
+
+// evictMount evicts entries of m until evictUntilPercentBlocksFree is
+// reached on its disk.
+func (n *Notify) evictMount(m *mount) {
+	blocksFree, _, _, err := n.diskUsage(m.point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", m.point).Error("Failed to get disk usage!")
+		return
+	}
+	if blocksFree >= n.minPercentBlocksFree {
+		return
+	}
+	n.evictDev(triggerWatermark, m.point, m.dev)
+}
+
+// evictDev evicts the entries on dev, mounted on point, until
+// evictUntilPercentBlocksFree is reached.
+func (n *Notify) evictDev(trigger, point string, dev uint64) {
+	g := n.newGuard(trigger)
+	n.evictDisk(g, &disk{mountPoint: point, dev: dev, entries: n.devEntries(dev)}, n.evictUntilPercentBlocksFree)
+	n.finish(g)
+}
+
+// parseMountinfo returns the mount points on or beneath root listed in
+// mountinfo(5) format by r, with the st_dev of their files.
+func parseMountinfo(r io.Reader, root string) (map[string]uint64, error) {
+	root = filepath.Clean(root)
+	// "/" would otherwise only match itself
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	points := make(map[string]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("malformed mountinfo line %q", scanner.Text())
+		}
+		point := unescapeMountinfo(fields[4])
+		if point != root && !strings.HasPrefix(point, prefix) {
+			continue
+		}
+		major, minor, ok := strings.Cut(fields[2], ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed device %q in mountinfo", fields[2])
+		}
+		maj, err := strconv.ParseUint(major, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed device %q in mountinfo", fields[2])
+		}
+		mnr, err := strconv.ParseUint(minor, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed device %q in mountinfo", fields[2])
+		}
+		// a later mount on the same point hides the earlier ones
+		points[point] = unix.Mkdev(uint32(maj), uint32(mnr))
+	}
+	return points, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes (\040 for a space...) the
+// kernel uses for special characters in mountinfo paths.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
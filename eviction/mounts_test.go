@@ -0,0 +1,89 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountinfo(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 22 8:17 / /mnt/kubernetes-disks-bazel/disk1 rw,relatime shared:2 - xfs /dev/sdb1 rw
+31 22 8:33 / /mnt/kubernetes-disks-bazel/disk\0402 rw,relatime shared:3 - xfs /dev/sdc1 rw
+32 22 8:49 / /mnt/kubernetes-disks-bazel-old rw,relatime shared:4 - xfs /dev/sdd1 rw
+`
+	points, err := parseMountinfo(strings.NewReader(mountinfo), "/mnt/kubernetes-disks-bazel/")
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{
+		"/mnt/kubernetes-disks-bazel/disk1":  unix.Mkdev(8, 17),
+		"/mnt/kubernetes-disks-bazel/disk 2": unix.Mkdev(8, 33),
+	}, points)
+
+	points, err = parseMountinfo(strings.NewReader(mountinfo), "/")
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{
+		"/":                                  unix.Mkdev(8, 1),
+		"/mnt/kubernetes-disks-bazel/disk1":  unix.Mkdev(8, 17),
+		"/mnt/kubernetes-disks-bazel/disk 2": unix.Mkdev(8, 33),
+		"/mnt/kubernetes-disks-bazel-old":    unix.Mkdev(8, 49),
+	}, points)
+
+	_, err = parseMountinfo(strings.NewReader("22 1 sda / /\n"), "/")
+	require.Error(t, err)
+}
+
+func TestMountPointOf(t *testing.T) {
+	n := &Notify{path: "/data1/bazel/cache", transfer: newTransfer("/mnt/kubernetes-disks-bazel", "/data1/bazel/cache")}
+	points := map[string]uint64{
+		"/":                                 1,
+		"/data1":                            2,
+		"/data1/bazel/cache/ws":             3,
+		"/mnt/kubernetes-disks-bazel/disk3": 3,
+	}
+	require.Equal(t, "/data1", n.mountPointOf(points, 2, "/data1/bazel/cache/ws0/cas/ab"))
+	require.Equal(t, "/mnt/kubernetes-disks-bazel/disk3", n.mountPointOf(points, 3, "/data1/bazel/cache/ws/cas/ab"))
+	require.Equal(t, "/data1/bazel/cache", n.mountPointOf(points, 4, "/data1/bazel/cache/ws/cas/ab"))
+}
+
+// mountTmpfs mounts a small tmpfs on dir for the duration of the test, it
+// skips the test where mounting is not allowed.
+func mountTmpfs(t *testing.T, dir string) uint64 {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, "size=16m"); err != nil {
+		t.Skipf("mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() { unix.Unmount(dir, unix.MNT_DETACH) })
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	return diskutil.GetDev(fi)
+}
+
+func TestDiskUsages(t *testing.T) {
+	dir := t.TempDir()
+	disk1 := filepath.Join(dir, "disk1")
+	dev := mountTmpfs(t, disk1)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "ws/cas"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ws/cas/a"), nil, 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(disk1, "ws/cas"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(disk1, "ws/cas/b"), nil, 0644))
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), transfer: newTransfer(dir, dir)}
+
+	require.Equal(t, []string{dir, disk1}, n.cacheMounts())
+	disks := n.diskUsages()
+	require.Len(t, disks, 2)
+	require.Equal(t, disk1, disks[1].mountPoint)
+	require.Equal(t, dev, disks[1].dev)
+	entries := n.devEntries(dev)
+	require.Len(t, entries, 1)
+	require.Equal(t, filepath.Join(disk1, "ws/cas/b"), entries[0].Path)
+	entries = n.devEntries(disks[0].dev)
+	require.Len(t, entries, 1)
+	require.Equal(t, filepath.Join(dir, "ws/cas/a"), entries[0].Path)
+}
@@ -1,11 +1,10 @@
 package eviction
 
 import (
+	"context"
 	"math"
-	"os"
-	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,117 +18,220 @@ import (
 type Notify struct {
 	path        string
 	disk        *diskutil.Cache
-	watcher     *inotify.Watcher
+	backend     Backend
+	eventBuffer EventBuffer
+	watcher     watcher
+	events      <-chan []*inotify.Event
+	errors      <-chan error
 	write       atomic.Int64
 	heavykeeper heavykeeper.Topk
 	transfer    *transfer
+	dedupe      *openDedupe
+	weights     Weights
+	openFiles   *openFiles
+	minAge      time.Duration
+	pins        PinRules
+	ttls        TTLRules
+	ttlInterval time.Duration
+	workspaces  Workspaces
+	classes     Classes
+	rules       *rulesLoader
+	dryRun      bool
+	auditLog    *AuditLog
+	manual      chan *manualPass
+	trash       *trash
+	throttle    *throttle
+	idleIO      bool
+	emergency   *emergency
+	predictor   *predictor
+	predicted   chan string
+	candidates  *candidates
+
+	// mount discovery, see mounts.go
+	discoverMounts    bool
+	diskCheckInterval time.Duration
+	mountsMu          sync.Mutex
+	mounts            map[string]*mount
+	pressure          chan *mount
 
 	minPercentBlocksFree        float64
 	evictUntilPercentBlocksFree float64
 }
 
-func New(path, listenPath string, minPercentBlocksFree, evictUntilPercentBlocksFree float64) *Notify {
-	disk := diskutil.NewCache(path)
-	watcher, err := inotify.NewWatcher()
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	filepath.Walk(listenPath, func(path string, f os.FileInfo, err error) error {
-		if err != nil {
-			logrus.WithError(err).Error("error getting some entries")
-			return nil
-		}
-		if f.IsDir() {
-			watcher.AddWatch(path, inotify.InOpen|inotify.InCreate|inotify.InIsdir)
-		}
-		return nil
-	})
+func New(path, listenPath string, minPercentBlocksFree, evictUntilPercentBlocksFree float64, opts ...Option) *Notify {
 	const HotKeyCnt = 1000_000
 	factor := uint32(math.Log(float64(HotKeyCnt)))
 	if factor < 1 {
 		factor = 1
 	}
-	heavykeeper := heavykeeper.NewHeavyKeeper(HotKeyCnt, 1024*factor, 4, 0.9, 1)
-	return &Notify{
+	topk := heavykeeper.NewHeavyKeeper(HotKeyCnt, 1024*factor, 4, 0.9, 1)
+	n := &Notify{
 		path:                        path,
 		transfer:                    newTransfer(listenPath, path),
-		disk:                        disk,
-		watcher:                     watcher,
+		disk:                        diskutil.NewCache(path),
+		backend:                     BackendInotify,
 		minPercentBlocksFree:        minPercentBlocksFree,
 		evictUntilPercentBlocksFree: evictUntilPercentBlocksFree,
-		heavykeeper:                 heavykeeper,
+		heavykeeper:                 heavykeeper.NewSync(topk),
+		dedupe:                      newOpenDedupe(0, false),
+		weights:                     DefaultWeights,
+		openFiles:                   newOpenFiles(false, false),
+		ttlInterval:                 time.Hour,
+		diskCheckInterval:           10 * time.Second,
+		mounts:                      make(map[string]*mount),
+		pressure:                    make(chan *mount, 1),
+		manual:                      make(chan *manualPass),
+		predicted:                   make(chan string, 1),
+		candidates:                  newCandidates(""),
+	}
+	for _, opt := range opts {
+		opt(n)
 	}
+	if err := n.newWatcher(listenPath); err != nil {
+		logrus.Fatal(err)
+	}
+	registerWatcherMetrics(listenPath, n.watcher.Stats)
+	return n
 }
 
-func (n *Notify) Start() {
-	ticker := time.NewTicker(15 * time.Minute)
-	defer ticker.Stop()
+// Start consumes file events until ctx is done, at which point the
+// watcher is closed.
+func (n *Notify) Start(ctx context.Context) {
+	if n.discoverMounts {
+		go n.discover(ctx)
+	}
+	if len(n.ttls) > 0 || n.rules != nil {
+		go n.expireLoop(ctx, n.ttlInterval)
+	}
+	if n.trash != nil {
+		interval := time.Minute
+		if n.trash.delay < interval {
+			interval = n.trash.delay
+		}
+		go n.purgeLoop(ctx, interval)
+	}
+	if n.emergency != nil {
+		go n.emergencyLoop(ctx)
+	}
+	if n.predictor != nil {
+		go n.predictLoop(ctx, n.diskCheckInterval)
+	}
+	go n.evictLoop(ctx)
 	for {
 		select {
-		case event, ok := <-n.watcher.Event:
+		case <-ctx.Done():
+			n.Stop()
+			return
+		case events, ok := <-n.events:
 			if !ok {
 				return
 			}
-			if strings.HasSuffix(event.Name, "/") {
-				continue
+			for _, event := range events {
+				n.handle(event)
 			}
-			if event.Mask&inotify.InIsdir == inotify.InIsdir {
-				if event.HasEvent(inotify.InCreate) {
-					n.watcher.AddWatch(event.Name, inotify.InOpen|inotify.InCreate|inotify.InIsdir)
-				}
+		case err, ok := <-n.errors:
+			if !ok {
+				n.errors = nil
 				continue
 			}
-			cache, err := n.transfer.tran(event.Name)
-			if err != nil {
-				logrus.WithError(err).Error("transfer path")
-			}
-			if event.HasEvent(inotify.InCreate) {
-				n.heavykeeper.Add(cache, 10)
-				n.write.Add(1)
-			} else {
-				n.heavykeeper.Add(cache, 1)
-			}
+			logrus.WithError(err).Error("watcher")
+		}
+	}
+}
+
+// evictLoop runs the eviction passes one at a time until ctx is done. It is
+// apart from the Start loop so that events keep being read while a pass
+// waits on the rate limit.
+func (n *Notify) evictLoop(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-n.pressure:
+			n.evictMount(m)
+		case point := <-n.predicted:
+			n.evictPredicted(point)
+		case p := <-n.manual:
+			n.manualEvict(p)
 		case <-ticker.C:
 			n.trickWorker()
 		}
 	}
-	return
 }
 
-func (n *Notify) Background() {
-	expelledChan := n.heavykeeper.Expelled()
+// handle accounts a single file event.
+func (n *Notify) handle(event *inotify.Event) {
+	if event.HasEvent(inotify.InUnmount) {
+		n.unmounted(event.Name)
+		return
+	}
+	if strings.HasSuffix(event.Name, "/") || inTrash(event.Name) {
+		return
+	}
+	if event.Mask&inotify.InIsdir == inotify.InIsdir {
+		if event.HasEvent(inotify.InCreate) || event.HasEvent(inotify.InMovedTo) {
+			n.watchTree(event.Name)
+		}
+		return
+	}
+	if event.HasEvent(inotify.InMovedFrom) {
+		// the file left the watched tree
+		return
+	}
+	cache, err := n.transfer.tran(event.Name)
+	if err != nil {
+		promMetrics.UnmappedPaths.WithLabelValues(n.transfer.listenDir).Inc()
+		logrus.WithError(err).WithField("path", event.Name).Debug("transfer path")
+		return
+	}
+	// files are usually written to a temporary name and renamed into place,
+	// so a rename or a move into the tree inserts the destination key.
+	if event.HasEvent(inotify.InCreate) || event.HasEvent(inotify.InRename) || event.HasEvent(inotify.InMovedTo) {
+		n.write.Add(1)
+	}
 	now := time.Now()
-	blocksFree := 0.0
-	var err error
-	for {
-		select {
-		case item := <-expelledChan:
-			if time.Since(now) > 5*time.Minute {
-				now = time.Now()
-				blocksFree, _, _, err = diskutil.GetDiskUsage(n.path)
-				if err != nil {
-					logrus.WithError(err).WithField("path", n.path).Error("Failed to get disk usage!")
-				}
-			}
-			if blocksFree > 50 {
-				continue
-			}
-			logrus.Infof("delete %s from expelledChan", item.Key)
-			os.Remove(item.Key)
+	n.openFiles.event(event, cache, now)
+	n.predictor.event(event, now)
+	skipOpen := event.HasEvent(inotify.InOpen) && n.dedupe.duplicate(cache, event.Pid, now)
+	if incr := n.weights.increment(event, cache, skipOpen); incr > 0 {
+		expelled, in := n.heavykeeper.Add(cache, incr)
+		if in {
+			n.candidates.remove(cache)
+		}
+		if expelled != "" {
+			n.candidates.push(expelled, now)
 		}
 	}
-	return
 }
 
+// Stop closes the watcher, it returns once the watcher stopped reading events.
 func (n *Notify) Stop() {
 	n.watcher.Close()
 }
 
 func (n *Notify) trickWorker() {
-	blocksFree, _, _, err := diskutil.GetDiskUsage(n.path)
-	if err != nil {
-		logrus.WithError(err).WithField("path", n.path).Error("Failed to get disk usage!")
-		return
+	// the disks are only walked for the quotas or once they need eviction
+	var disks []*disk
+	if n.workspaces.hasQuotas() {
+		disks = n.disks()
+		var entries []diskutil.EntryInfo
+		for _, d := range disks {
+			entries = append(entries, d.entries...)
+		}
+		g := n.newGuard(triggerQuota)
+		n.enforceQuotas(g, entries)
+		n.finish(g)
+	} else {
+		disks = n.diskUsages()
+	}
+	// the fullest disk decides how many writes trigger a cleanup
+	blocksFree := 100.0
+	for _, d := range disks {
+		if d.blocksFree < blocksFree {
+			blocksFree = d.blocksFree
+		}
 	}
 	var value int64 = 0
 	if blocksFree > 70 {
@@ -139,41 +241,118 @@ func (n *Notify) trickWorker() {
 	}
 	if n.write.Load() > value {
 		n.write.Store(0)
-		n.topkCleaner()
+		n.topkCleaner(disks)
 	}
 }
 
-func (n *Notify) topkCleaner() {
+// TopkFreePercent is the free space topkCleaner restores on every disk, in
+// percent of its blocks.
+const TopkFreePercent = 30
+
+// topkCleaner evicts entries from every disk that is running low on space.
+func (n *Notify) topkCleaner(disks []*disk) {
 	n.heavykeeper.Fading()
-	top := n.heavykeeper.List()
-	topset := make(map[string]uint32)
-	for _, item := range top {
-		topset[item.Key] = item.Count
+	for _, d := range disks {
+		if d.blocksFree > TopkFreePercent {
+			logrus.WithField("mount", d.mountPoint).WithField("blocksFree", d.blocksFree).Info("blocksFree > 30, skip topkCleaner")
+			continue
+		}
+		if d.entries == nil {
+			d.entries = n.devEntries(d.dev)
+		}
+		g := n.newGuard(triggerWatermark)
+		n.evictDisk(g, d, TopkFreePercent)
+		n.finish(g)
 	}
+}
+
+// manualPass is an eviction pass requested through Evict.
+type manualPass struct {
+	freePercent float64
+	files       int
+	bytes       int64
+	err         error
+	done        chan struct{}
+}
+
+// Evict runs an eviction pass getting freePercent of every disk of the
+// cache free, like topkCleaner does, on the eviction loop. It returns the
+// number of files and bytes evicted, and an error if a disk couldn't be
+// evicted or entries couldn't be deleted.
+func (n *Notify) Evict(ctx context.Context, freePercent float64) (files int, bytes int64, err error) {
+	p := &manualPass{freePercent: freePercent, done: make(chan struct{})}
+	select {
+	case n.manual <- p:
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+	<-p.done
+	return p.files, p.bytes, p.err
+}
+
+func (n *Notify) manualEvict(p *manualPass) {
+	defer close(p.done)
+	g := n.newGuard(triggerManual)
+	for _, d := range n.disks() {
+		n.evictDisk(g, d, p.freePercent)
+	}
+	n.finish(g)
+	p.files, p.bytes, p.err = g.files, g.bytes, g.failure()
+}
 
-	blocksFree, _, _, err := diskutil.GetDiskUsage(n.path)
+// evictDisk deletes entries of d until freePercent of its blocks are free,
+// counting the trash as free. The entries are taken in fair share order
+// between the workspaces, lowest score first within a workspace. Below
+// the minimum free space the trash of d is purged first.
+func (n *Notify) evictDisk(g *guard, d *disk, freePercent float64) {
+	blocksFree, bytesFree, bytesUsed, err := n.diskUsage(d.mountPoint)
 	if err != nil {
-		logrus.WithError(err).WithField("path", n.path).Error("Failed to get disk usage!")
+		logrus.WithError(err).WithField("mount", d.mountPoint).Error("Failed to get disk usage!")
+		g.fail(err)
 		return
 	}
-	logrus.Infof("topk %d", len(top))
-	if blocksFree > 30 {
-		logrus.WithField("blocksFree", blocksFree).Info("blocksFree > 70, skip topkCleaner")
+	if g.plan == nil && blocksFree < n.minPercentBlocksFree && n.trashBytes(d.dev) > 0 {
+		n.purgeTrash("pressure", func(b trashBatch) bool { return b.dev == d.dev })
+		if blocksFree, bytesFree, bytesUsed, err = n.diskUsage(d.mountPoint); err != nil {
+			logrus.WithError(err).WithField("mount", d.mountPoint).Error("Failed to get disk usage!")
+			g.fail(err)
+			return
+		}
+	}
+	target := int64(float64(bytesFree+bytesUsed)*freePercent/100) - int64(bytesFree) - n.trashBytes(d.dev)
+	if g.plan != nil {
+		// what the plan already frees on the disk, e.g. for quotas
+		target -= g.plan.freed[d.dev]
+	}
+	if target <= 0 {
 		return
 	}
-	files := n.disk.GetEntries()
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].LastAccess.Before(files[j].LastAccess)
-	})
-	for _, entry := range files {
-		_, ok := topset[entry.Path]
-		if !ok {
-			err = n.disk.Delete(n.disk.PathToKey(entry.Path))
-			if err != nil {
-				logrus.WithError(err).Errorf("Error deleting entry at path: %v", entry.Path)
-			} else {
-				logrus.Infof("delete %s", entry.Path)
+	if g.plan == nil {
+		logrus.WithField("mount", d.mountPoint).WithField("blocksFree", blocksFree).Infof("evicting %d bytes", target)
+	}
+	var freed int64
+	tried := make(map[string]bool)
+	for _, entry := range n.candidates.queued(d.entries) {
+		if freed >= target {
+			return
+		}
+		tried[entry.Path] = true
+		if deleted, _ := n.evict(g, entry, policyExpelled); deleted {
+			freed += entry.Size
+			if g.plan == nil {
+				n.candidates.remove(entry.Path)
 			}
 		}
 	}
+	for _, entry := range n.fairShare(d.entries, n.workspaceUsage(d.entries)) {
+		if freed >= target {
+			break
+		}
+		if tried[entry.Path] {
+			continue
+		}
+		if deleted, _ := n.evict(g, entry, policyScore); deleted {
+			freed += entry.Size
+		}
+	}
 }
@@ -0,0 +1,193 @@
+package eviction
+
+import "time"
+
+// Option configures optional behaviour of a Notify.
+type Option func(*Notify)
+
+// WithBackend selects the file watching backend, BackendInotify by default.
+func WithBackend(backend Backend) Option {
+	return func(n *Notify) {
+		n.backend = backend
+	}
+}
+
+// WithEventBuffer configures the buffer between the watcher and Notify,
+// zero fields keep their defaults.
+func WithEventBuffer(buffer EventBuffer) Option {
+	return func(n *Notify) {
+		n.eventBuffer = buffer
+	}
+}
+
+// WithOpenDedupe counts the opens of a file within window once, so that
+// hotness reflects distinct uses. With perSession the window is tracked per
+// process session, which needs the PIDs only BackendFanotify reports.
+func WithOpenDedupe(window time.Duration, perSession bool) Option {
+	return func(n *Notify) {
+		n.dedupe = newOpenDedupe(window, perSession)
+	}
+}
+
+// WithWeights configures how much each file event adds to a file's hotness,
+// and thereby which events are subscribed to.
+func WithWeights(weights Weights) Option {
+	return func(n *Notify) {
+		n.weights = weights
+	}
+}
+
+// WithPathMapping replaces DefaultPathMapping, the rules that map watched
+// paths to cache keys.
+func WithPathMapping(mapping PathMapping) Option {
+	return func(n *Notify) {
+		if len(mapping) > 0 {
+			n.transfer.mapping = mapping
+		}
+	}
+}
+
+// WithOpenFileCheck configures whether entries that are open, as seen
+// through open and close events, are kept by eviction. With procScan the
+// file descriptors in /proc are checked as well, which also catches files
+// opened before Notify started. It is off by default: the close events it
+// needs about double the events to handle.
+func WithOpenFileCheck(enabled, procScan bool) Option {
+	return func(n *Notify) {
+		n.openFiles = newOpenFiles(enabled, procScan)
+	}
+}
+
+// WithMinAge keeps entries younger than age out of eviction, the age is
+// taken from the birth time of the file, or its ctime where there is none.
+func WithMinAge(age time.Duration) Option {
+	return func(n *Notify) {
+		n.minAge = age
+	}
+}
+
+// WithPinRules keeps the entries matching rules out of eviction.
+func WithPinRules(rules PinRules) Option {
+	return func(n *Notify) {
+		n.pins = rules
+	}
+}
+
+// WithTTLRules expires the entries matching rules, checking every interval.
+func WithTTLRules(rules TTLRules, interval time.Duration) Option {
+	return func(n *Notify) {
+		n.ttls = rules
+		if interval > 0 {
+			n.ttlInterval = interval
+		}
+	}
+}
+
+// WithWorkspaces configures the quotas and fair share weights of the
+// workspaces.
+func WithWorkspaces(workspaces Workspaces) Option {
+	return func(n *Notify) {
+		n.workspaces = workspaces
+	}
+}
+
+// WithClasses configures the priority classes scaling the eviction score.
+func WithClasses(classes Classes) Option {
+	return func(n *Notify) {
+		n.classes = classes
+	}
+}
+
+// WithRules applies the rules file at path, it is reloaded when it changes.
+// A file that fails to load is logged and leaves the previous rules, if any,
+// in place, callers should check it with LoadRules first.
+func WithRules(path string) Option {
+	return func(n *Notify) {
+		if path != "" {
+			n.rules = &rulesLoader{path: path}
+		}
+	}
+}
+
+// WithDryRun makes every eviction path log and count the entries it would
+// delete instead of deleting them.
+func WithDryRun(dryRun bool) Option {
+	return func(n *Notify) {
+		n.dryRun = dryRun
+	}
+}
+
+// WithAuditLog records every eviction, and a summary of every eviction
+// pass, in log.
+func WithAuditLog(log *AuditLog) Option {
+	return func(n *Notify) {
+		n.auditLog = log
+	}
+}
+
+// WithTrash moves evicted entries into a trash dir on their filesystem,
+// from which they can be restored until they are purged after delay, or
+// when their disk runs below the minimum free space. Zero disables it.
+func WithTrash(delay time.Duration) Option {
+	return func(n *Notify) {
+		if delay > 0 {
+			n.trash = newTrash(delay)
+		}
+	}
+}
+
+// WithRateLimit caps eviction at files deletions and bytes deleted a
+// second, zero leaves either unlimited. With idleIO the deletions run in
+// the idle IO class, only getting disk time no build wants.
+func WithRateLimit(files, bytes float64, idleIO bool) Option {
+	return func(n *Notify) {
+		n.throttle = newThrottle(files, bytes)
+		n.idleIO = idleIO
+	}
+}
+
+// WithEmergency evicts from the disks running below floor percent of
+// blocks free right away, largest and coldest entries first, until they
+// are back above the minimum free space. The workspaces whose entries were
+// all last used more than coldAge ago are deleted whole first, zero keeps
+// them. A zero floor disables it.
+func WithEmergency(floor float64, coldAge time.Duration) Option {
+	return func(n *Notify) {
+		if floor > 0 {
+			n.emergency = &emergency{floor: floor, coldAge: coldAge, disks: make(map[string]*emergencyDisk)}
+		}
+	}
+}
+
+// WithPrediction estimates how fast every disk of the cache fills up from
+// the sizes of the files written to it, exports the projected time until
+// it is full and evicts from it as soon as it would reach the minimum free
+// space within lead, checking every disk check interval. Zero disables it.
+func WithPrediction(lead time.Duration) Option {
+	return func(n *Notify) {
+		if lead > 0 {
+			n.predictor = newPredictor(lead)
+		}
+	}
+}
+
+// WithCandidatesFile saves the queue of entries expelled from the top-k,
+// evicted first once their disk needs space, to path so that it survives
+// restarts, see Background.
+func WithCandidatesFile(path string) Option {
+	return func(n *Notify) {
+		n.candidates = newCandidates(path)
+	}
+}
+
+// WithMountDiscovery watches /proc/self/mountinfo for filesystems mounted
+// beneath the listen dir, each one gets its own watches and is evicted on its
+// own once it runs low on space, checking every interval.
+func WithMountDiscovery(interval time.Duration) Option {
+	return func(n *Notify) {
+		n.discoverMounts = true
+		if interval > 0 {
+			n.diskCheckInterval = interval
+		}
+	}
+}
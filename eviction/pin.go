@@ -0,0 +1,116 @@
+package eviction
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PinRules lists the cache entries that are never evicted, a rule matches
+// keys relative to the cache dir.
+//
+// Rules are written as
+//
+//	glob:PATTERN     match the leading path segments of the key against PATTERN
+//	                 (path.Match syntax), e.g. release-* pins every workspace
+//	                 named release-*, toolchains/cas pins the CAS of toolchains
+//	prefix:STRING    match keys starting with STRING
+//	regex:RE         match keys against the regular expression RE, unanchored
+//
+// a rule without a kind is a glob. PinRules implements flag.Value, each Set
+// appends one rule.
+type PinRules []pathPattern
+
+// String implements flag.Value.
+func (p *PinRules) String() string {
+	if p == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(*p))
+	for _, rule := range *p {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+// Set implements flag.Value.
+func (p *PinRules) Set(s string) error {
+	pattern, err := parsePathPattern(s)
+	if err != nil {
+		return fmt.Errorf("invalid pin rule %q: %w", s, err)
+	}
+	*p = append(*p, pattern)
+	return nil
+}
+
+// pinned reports whether key, relative to the cache dir, matches a rule.
+func (p PinRules) pinned(key string) bool {
+	for _, rule := range p {
+		if rule.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathPattern matches cache keys, it is written as glob:PATTERN,
+// prefix:STRING, regex:RE or PATTERN, see PinRules.
+type pathPattern struct {
+	glob   string
+	prefix string
+	regex  *regexp.Regexp
+}
+
+func parsePathPattern(s string) (pathPattern, error) {
+	kind, arg, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, arg = "glob", s
+	}
+	if arg == "" {
+		return pathPattern{}, fmt.Errorf("empty pattern")
+	}
+	switch kind {
+	case "glob":
+		arg = strings.Trim(arg, "/")
+		if _, err := path.Match(arg, ""); err != nil {
+			return pathPattern{}, err
+		}
+		return pathPattern{glob: arg}, nil
+	case "prefix":
+		return pathPattern{prefix: arg}, nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return pathPattern{}, err
+		}
+		return pathPattern{regex: re}, nil
+	}
+	return pathPattern{}, fmt.Errorf("unknown pattern kind %q", kind)
+}
+
+func (r pathPattern) match(key string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(key)
+	}
+	if r.glob == "" {
+		return strings.HasPrefix(key, r.prefix)
+	}
+	n := strings.Count(r.glob, "/") + 1
+	segments := strings.SplitN(key, "/", n+1)
+	if len(segments) < n {
+		return false
+	}
+	ok, _ := path.Match(r.glob, strings.Join(segments[:n], "/"))
+	return ok
+}
+
+func (r pathPattern) String() string {
+	if r.regex != nil {
+		return "regex:" + r.regex.String()
+	}
+	if r.glob == "" {
+		return "prefix:" + r.prefix
+	}
+	return "glob:" + r.glob
+}
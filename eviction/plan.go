@@ -0,0 +1,83 @@
+package eviction
+
+import (
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+)
+
+// Plan lists the entries an eviction pass would delete, without deleting
+// them.
+type Plan struct {
+	Dir         string         `json:"dir"`
+	At          time.Time      `json:"at"`
+	FreePercent float64        `json:"free-percent"`
+	Bytes       int64          `json:"bytes"`
+	Victims     []Victim       `json:"victims"`
+	Kept        map[string]int `json:"kept"` // Protected candidates by reason
+
+	planned map[string]bool
+	freed   map[uint64]int64 // Bytes by device
+}
+
+// Victim is an entry of a Plan.
+type Victim struct {
+	Key       string    `json:"key"`
+	Workspace string    `json:"workspace"`
+	Size      int64     `json:"size"`
+	Atime     time.Time `json:"atime"`
+	Age       string    `json:"age"`
+	Hotness   uint32    `json:"hotness"`
+	Score     float64   `json:"score"`
+	Policy    string    `json:"policy"`
+}
+
+// Plan computes what a cleanup pass would delete to get freePercent of
+// every disk of the cache free: the entries of workspaces over their quota,
+// then the lowest scoring entries in fair share order. It is safe to call
+// while Start is running.
+func (n *Notify) Plan(freePercent float64) *Plan {
+	g := n.newGuard(triggerPlan)
+	g.plan = &Plan{
+		Dir:         n.path,
+		At:          g.now,
+		FreePercent: freePercent,
+		Victims:     []Victim{},
+		Kept:        g.kept,
+		planned:     make(map[string]bool),
+		freed:       make(map[uint64]int64),
+	}
+	disks := n.disks()
+	var entries []diskutil.EntryInfo
+	for _, d := range disks {
+		entries = append(entries, d.entries...)
+	}
+	n.enforceQuotas(g, entries)
+	for _, d := range disks {
+		n.evictDisk(g, d, freePercent)
+	}
+	return g.plan
+}
+
+// add records entry as a victim of policy, it reports false for entries
+// that already are.
+func (p *Plan) add(n *Notify, entry diskutil.EntryInfo, policy string, now time.Time) bool {
+	if p.planned[entry.Path] {
+		return false
+	}
+	p.planned[entry.Path] = true
+	p.freed[entry.Dev] += entry.Size
+	p.Bytes += entry.Size
+	e := n.entry(entry)
+	p.Victims = append(p.Victims, Victim{
+		Key:       e.Key,
+		Workspace: e.Workspace,
+		Size:      entry.Size,
+		Atime:     entry.LastAccess,
+		Age:       now.Sub(entry.LastAccess).Round(time.Second).String(),
+		Hotness:   e.Hotness,
+		Score:     n.score(entry, now),
+		Policy:    policy,
+	})
+	return true
+}
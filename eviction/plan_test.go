@@ -0,0 +1,60 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/heavykeeper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	var ws Workspaces
+	require.NoError(t, ws.Set("pr=quota=2K"))
+	var pins PinRules
+	require.NoError(t, pins.Set("main/cas/a"))
+	n := &Notify{
+		path:        dir,
+		disk:        diskutil.NewCache(dir),
+		transfer:    newTransfer(dir, dir),
+		heavykeeper: heavykeeper.NewHeavyKeeper(10, 100, 4, 0.9, 1),
+		openFiles:   newOpenFiles(true, false),
+		workspaces:  ws,
+		pins:        pins,
+	}
+	now := time.Now()
+	keys := []string{"pr/cas/a", "pr/cas/b", "pr/cas/c", "main/cas/a", "main/cas/b"}
+	for i, key := range keys {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 1024), 0644))
+		at := now.Add(-time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+
+	plan := n.Plan(0)
+	require.Len(t, plan.Victims, 1)
+	require.Equal(t, "pr/cas/c", plan.Victims[0].Key)
+	require.Equal(t, "pr", plan.Victims[0].Workspace)
+	require.Equal(t, policyQuota, plan.Victims[0].Policy)
+	require.Equal(t, "2h0m0s", plan.Victims[0].Age)
+	require.EqualValues(t, 1024, plan.Bytes)
+
+	// no disk can be 100% free, so everything but the pinned entry goes
+	plan = n.Plan(100)
+	require.Len(t, plan.Victims, 4)
+	require.Equal(t, policyQuota, plan.Victims[0].Policy)
+	for _, v := range plan.Victims[1:] {
+		require.Equal(t, policyScore, v.Policy, v.Key)
+		require.NotEqual(t, "main/cas/a", v.Key)
+	}
+	require.Equal(t, map[string]int{reasonPinned: 1}, plan.Kept)
+
+	for _, key := range keys {
+		require.FileExists(t, filepath.Join(dir, key))
+	}
+}
@@ -0,0 +1,185 @@
+package eviction
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/sirupsen/logrus"
+)
+
+// fillRateMinutes is the window the fill rate is averaged over, in one
+// minute buckets.
+const fillRateMinutes = 5
+
+// predictor estimates how fast the disks of the cache fill up from the
+// sizes of the files written to them, so that eviction starts before a
+// disk reaches the minimum free space, see WithPrediction.
+type predictor struct {
+	lead time.Duration // Evict when the minimum free space is this close
+
+	mu      sync.Mutex
+	buckets map[uint64]*[fillRateMinutes]fillBucket // By device
+	minute  int64                                   // Of seen
+	seen    map[fileID]struct{}                     // Files counted this minute
+}
+
+type fillBucket struct {
+	minute int64 // Unix minute the bytes were written in
+	bytes  int64
+}
+
+type fileID struct {
+	dev, ino uint64
+}
+
+func newPredictor(lead time.Duration) *predictor {
+	return &predictor{
+		lead:    lead,
+		buckets: make(map[uint64]*[fillRateMinutes]fillBucket),
+		seen:    make(map[fileID]struct{}),
+	}
+}
+
+// mask returns the events to subscribe to: files are sized once written
+// and closed, or renamed into place.
+func (p *predictor) mask() uint32 {
+	if p == nil {
+		return 0
+	}
+	return inotify.InCloseWrite | inotify.InMove
+}
+
+// event accounts the size of the file of event if it completes a write of
+// it. The file is looked up by its watched name, the cache key may map it
+// through another mount.
+func (p *predictor) event(event *inotify.Event, now time.Time) {
+	if p == nil || !(event.HasEvent(inotify.InCloseWrite) || event.HasEvent(inotify.InRename) || event.HasEvent(inotify.InMovedTo)) {
+		return
+	}
+	fi, err := os.Lstat(event.Name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	p.add(fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, fi.Size(), now)
+}
+
+// add accounts size bytes written to the file id at now, a file written
+// and then renamed into place counts once.
+func (p *predictor) add(id fileID, size int64, now time.Time) {
+	minute := now.Unix() / 60
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if minute != p.minute {
+		p.minute = minute
+		p.seen = make(map[fileID]struct{})
+	}
+	if _, ok := p.seen[id]; ok {
+		return
+	}
+	p.seen[id] = struct{}{}
+	buckets, ok := p.buckets[id.dev]
+	if !ok {
+		buckets = new([fillRateMinutes]fillBucket)
+		p.buckets[id.dev] = buckets
+	}
+	b := &buckets[minute%fillRateMinutes]
+	if b.minute != minute {
+		*b = fillBucket{minute: minute}
+	}
+	b.bytes += size
+}
+
+// rate returns the bytes a second written to dev over the last
+// fillRateMinutes minutes before now.
+func (p *predictor) rate(dev uint64, now time.Time) float64 {
+	minute := now.Unix() / 60
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buckets, ok := p.buckets[dev]
+	if !ok {
+		return 0
+	}
+	var bytes int64
+	for _, b := range buckets {
+		if minute-b.minute < fillRateMinutes {
+			bytes += b.bytes
+		}
+	}
+	return float64(bytes) / (fillRateMinutes * 60)
+}
+
+// predictLoop projects when the disks of the cache dir run out of space
+// every interval until ctx is done, and asks the eviction loop to evict from
+// those that would reach the minimum free space within the lead time.
+func (n *Notify) predictLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, point := range n.cacheMounts() {
+				if n.predict(point, now) {
+					select {
+					case n.predicted <- point:
+					default:
+						// an eviction is already pending
+					}
+				}
+			}
+		}
+	}
+}
+
+// predict exports the fill rate and the projected time to full of the disk
+// mounted on point, and reports whether it should be evicted early: it
+// would reach the minimum free space within the lead time and isn't above
+// the free space evictions restore.
+func (n *Notify) predict(point string, now time.Time) bool {
+	fi, err := os.Stat(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to stat mount")
+		return false
+	}
+	blocksFree, bytesFree, bytesUsed, err := n.diskUsage(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to get disk usage!")
+		return false
+	}
+	rate := n.predictor.rate(diskutil.GetDev(fi), now)
+	toFull, toFloor := math.Inf(1), math.Inf(1)
+	if rate > 0 {
+		toFull = float64(bytesFree) / rate
+		toFloor = (float64(bytesFree) - float64(bytesFree+bytesUsed)*n.minPercentBlocksFree/100) / rate
+	}
+	promMetrics.FillRate.WithLabelValues(n.path, point).Set(rate * 60)
+	promMetrics.SecondsToFull.WithLabelValues(n.path, point).Set(toFull)
+	if toFloor >= n.predictor.lead.Seconds() || blocksFree >= n.evictUntilPercentBlocksFree {
+		return false
+	}
+	logrus.WithField("mount", point).WithField("blocksFree", blocksFree).
+		Infof("filling at %.0f bytes/s, minimum free space in %s, evicting early", rate, time.Duration(toFloor*float64(time.Second)).Round(time.Second))
+	return true
+}
+
+// evictPredicted evicts entries of the disk mounted on point until
+// evictUntilPercentBlocksFree is reached, ahead of the minimum free space.
+func (n *Notify) evictPredicted(point string) {
+	fi, err := os.Stat(point)
+	if err != nil {
+		logrus.WithError(err).WithField("mount", point).Error("Failed to stat mount")
+		return
+	}
+	n.evictDev(triggerPredicted, point, diskutil.GetDev(fi))
+}
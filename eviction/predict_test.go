@@ -0,0 +1,76 @@
+package eviction
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredictorRate(t *testing.T) {
+	p := newPredictor(time.Minute)
+	now := time.Unix(1_000_000*60, 0)
+	p.add(fileID{dev: 1, ino: 1}, 6000, now)
+	// written then renamed into place
+	p.add(fileID{dev: 1, ino: 1}, 6000, now.Add(time.Second))
+	p.add(fileID{dev: 1, ino: 2}, 12000, now.Add(time.Minute))
+	p.add(fileID{dev: 2, ino: 1}, 1<<20, now)
+	require.Equal(t, 60.0, p.rate(1, now.Add(time.Minute)))
+	// the first minute left the window
+	require.Equal(t, 40.0, p.rate(1, now.Add(fillRateMinutes*time.Minute)))
+	require.Zero(t, p.rate(1, now.Add(2*fillRateMinutes*time.Minute)))
+	require.Zero(t, p.rate(3, now))
+}
+
+func TestPredictorEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	require.NoError(t, os.WriteFile(path, make([]byte, 600), 0644))
+	p := newPredictor(time.Minute)
+	now := time.Now()
+	p.event(&inotify.Event{Mask: inotify.InCreate, Name: path}, now)
+	p.event(&inotify.Event{Mask: inotify.InOpen, Name: path}, now)
+	require.Empty(t, p.buckets)
+	p.event(&inotify.Event{Mask: inotify.InCloseWrite, Name: path}, now)
+	p.event(&inotify.Event{Mask: inotify.InMovedTo, Name: path}, now)
+	require.Len(t, p.buckets, 1)
+	for dev := range p.buckets {
+		require.Equal(t, 2.0, p.rate(dev, now))
+	}
+
+	var disabled *predictor
+	require.Zero(t, disabled.mask())
+	disabled.event(&inotify.Event{Mask: inotify.InCloseWrite, Name: path}, now)
+}
+
+func TestPredictMounts(t *testing.T) {
+	dir := t.TempDir()
+	disk1, disk2 := filepath.Join(dir, "disk1"), filepath.Join(dir, "disk2")
+	mountTmpfs(t, disk1)
+	mountTmpfs(t, disk2)
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), transfer: newTransfer(dir, dir), predictor: newPredictor(time.Hour),
+		minPercentBlocksFree: 80, evictUntilPercentBlocksFree: 90, predicted: make(chan string, 1)}
+	path := filepath.Join(disk1, "entry")
+	require.NoError(t, os.WriteFile(path, make([]byte, 2<<20), 0644))
+	now := time.Now()
+	n.predictor.event(&inotify.Event{Mask: inotify.InCloseWrite, Name: path}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.predictLoop(ctx, 10*time.Millisecond)
+	select {
+	case point := <-n.predicted:
+		require.Equal(t, disk1, point)
+	case <-time.After(5 * time.Second):
+		t.Fatal("disk1 wasn't predicted to fill up")
+	}
+	cancel()
+	require.Equal(t, float64(2<<20)*60/(fillRateMinutes*60), testutil.ToFloat64(promMetrics.FillRate.WithLabelValues(dir, disk1)))
+	require.Zero(t, testutil.ToFloat64(promMetrics.FillRate.WithLabelValues(dir, disk2)))
+	require.False(t, n.predict(disk2, now))
+}
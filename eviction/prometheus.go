@@ -0,0 +1,168 @@
+package eviction
+
+import (
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// global metrics object, registered with the default registry
+var promMetrics *prometheusMetrics
+
+func init() {
+	promMetrics = initMetrics()
+}
+
+// prometheusMetrics are served by /prometheus on the metrics port
+type prometheusMetrics struct {
+	UnmappedPaths *prometheus.CounterVec
+	MountFree     *prometheus.GaugeVec
+	MountUsed     *prometheus.GaugeVec
+	MountTotal    *prometheus.GaugeVec
+
+	EvictionsSkipped *prometheus.CounterVec
+	PinnedBytes      *prometheus.GaugeVec
+	ExpiredBytes     *prometheus.CounterVec
+	RulesReloads     *prometheus.CounterVec
+	DryRunBytes      *prometheus.CounterVec
+	TrashBytes       *prometheus.GaugeVec
+	TrashPurgedBytes *prometheus.CounterVec
+	ThrottledSeconds *prometheus.CounterVec
+	EmergencyActive  *prometheus.GaugeVec
+	EmergencyPasses  *prometheus.CounterVec
+	FillRate         *prometheus.GaugeVec
+	SecondsToFull    *prometheus.GaugeVec
+
+	ExpelledCandidates *prometheus.GaugeVec
+
+	WorkspaceBytes        *prometheus.GaugeVec
+	WorkspaceEvictedBytes *prometheus.CounterVec
+}
+
+func initMetrics() *prometheusMetrics {
+	metrics := &prometheusMetrics{
+		UnmappedPaths: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_unmapped_paths",
+			Help: "Number of file events skipped because no path mapping rule maps them into the cache dir",
+		}, []string{"listen_dir"}),
+		MountFree: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_mount_free",
+			Help: "Free gb on a disk holding cache entries",
+		}, []string{"mount"}),
+		MountUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_mount_used",
+			Help: "Used gb on a disk holding cache entries",
+		}, []string{"mount"}),
+		MountTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_mount_total",
+			Help: "Total gb on a disk holding cache entries",
+		}, []string{"mount"}),
+		EvictionsSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_evictions_skipped",
+			Help: "Number of times an entry chosen for eviction was kept, by reason",
+		}, []string{"dir", "reason"}),
+		PinnedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_pinned_bytes",
+			Help: "Bytes of cache entries matching a pin rule, they are never evicted",
+		}, []string{"dir"}),
+		ExpiredBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_expired_bytes",
+			Help: "Bytes of cache entries deleted because they outlived their TTL rule",
+		}, []string{"dir", "rule"}),
+		RulesReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_rules_reloads",
+			Help: "Loads of the eviction rules file by result, success or error",
+		}, []string{"file", "result"}),
+		DryRunBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_dry_run_evicted_bytes",
+			Help: "Bytes of cache entries that would have been evicted in dry-run mode, by policy",
+		}, []string{"dir", "policy"}),
+		TrashBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_trash_bytes",
+			Help: "Bytes of evicted cache entries waiting in the trash to be purged",
+		}, []string{"dir"}),
+		TrashPurgedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_trash_purged_bytes",
+			Help: "Bytes purged from the trash, by reason: expired or pressure",
+		}, []string{"dir", "reason"}),
+		ThrottledSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_eviction_throttled_seconds",
+			Help: "Seconds eviction waited on the rate limit",
+		}, []string{"dir"}),
+		EmergencyActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_emergency",
+			Help: "1 while a disk is in emergency eviction, from falling below the hard floor until it is back above the minimum free space",
+		}, []string{"dir", "mount"}),
+		EmergencyPasses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_emergency_passes",
+			Help: "Number of emergency eviction passes",
+		}, []string{"dir"}),
+		FillRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_fill_rate",
+			Help: "Bytes written to the disk per minute, averaged over the last minutes",
+		}, []string{"dir", "mount"}),
+		SecondsToFull: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_projected_seconds_to_full",
+			Help: "Seconds until the disk is full at the current fill rate, +Inf when nothing is written",
+		}, []string{"dir", "mount"}),
+		ExpelledCandidates: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_expelled_candidates",
+			Help: "Cache entries expelled from the top-k, queued to be evicted first once their disk needs space",
+		}, []string{"dir"}),
+		WorkspaceBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_cache_workspace_bytes",
+			Help: "Bytes of cache entries by workspace",
+		}, []string{"dir", "workspace"}),
+		WorkspaceEvictedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bazel_cache_workspace_evicted_bytes",
+			Help: "Bytes of cache entries evicted by workspace",
+		}, []string{"dir", "workspace"}),
+	}
+	prometheus.MustRegister(metrics.UnmappedPaths)
+	prometheus.MustRegister(metrics.EvictionsSkipped)
+	prometheus.MustRegister(metrics.PinnedBytes)
+	prometheus.MustRegister(metrics.ExpiredBytes)
+	prometheus.MustRegister(metrics.RulesReloads)
+	prometheus.MustRegister(metrics.DryRunBytes)
+	prometheus.MustRegister(metrics.TrashBytes)
+	prometheus.MustRegister(metrics.TrashPurgedBytes)
+	prometheus.MustRegister(metrics.ThrottledSeconds)
+	prometheus.MustRegister(metrics.EmergencyActive)
+	prometheus.MustRegister(metrics.EmergencyPasses)
+	prometheus.MustRegister(metrics.FillRate)
+	prometheus.MustRegister(metrics.SecondsToFull)
+	prometheus.MustRegister(metrics.ExpelledCandidates)
+	prometheus.MustRegister(metrics.WorkspaceBytes)
+	prometheus.MustRegister(metrics.WorkspaceEvictedBytes)
+	prometheus.MustRegister(metrics.MountFree)
+	prometheus.MustRegister(metrics.MountUsed)
+	prometheus.MustRegister(metrics.MountTotal)
+	return metrics
+}
+
+// registerWatcherMetrics exports the event buffer counters of the watcher
+// on listenDir, they are served by /prometheus on the metrics port.
+func registerWatcherMetrics(listenDir string, stats func() inotify.BufferStats) {
+	labels := prometheus.Labels{"listen_dir": listenDir}
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "bazel_cache_watcher_events_dropped",
+			Help:        "Number of file events dropped because the event buffer was full",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(stats().Dropped)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "bazel_cache_watcher_events_coalesced",
+			Help:        "Number of file events merged into an already buffered event",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(stats().Coalesced)
+		}),
+	}
+	for _, c := range collectors {
+		if err := prometheus.Register(c); err != nil {
+			logrus.WithError(err).WithField("listen-dir", listenDir).Error("Failed to register watcher metrics")
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package eviction
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules are eviction policies matching cache entries by path, kind, age and
+// size, loaded from a YAML file:
+//
+//	keep:
+//	  - path: release
+//	  - path: prefix:toolchains/
+//	ttl:
+//	  - kind: ac
+//	    older-than: 72h
+//	  - path: pr-*
+//	    larger-than: 1K
+//	priority:
+//	  - path: regex:^pr-[0-9]+/
+//	    weight: 0.5
+//	  - kind: cas
+//	    weight: 3
+//
+// Entries matching a keep rule are never evicted, entries matching a ttl
+// rule are deleted by the TTL sweeper and the score of entries matching
+// priority rules is multiplied by their weight. A rule matches the entries
+// meeting all of its conditions:
+//
+//	path          key of the entry, relative to the cache dir, with the
+//	              patterns of PinRules
+//	kind          ac or cas
+//	older-than    last accessed longer ago than this duration
+//	newer-than    last accessed less long ago than this duration
+//	larger-than   bytes, with the suffixes of ParseBytes
+//	smaller-than  bytes
+type Rules struct {
+	keep     []rule
+	ttl      []rule
+	priority []priorityRule
+}
+
+type priorityRule struct {
+	rule
+	weight float64
+}
+
+// rule is a rule of the rules file, zero fields match every entry.
+type rule struct {
+	src         string // Conditions as written, for logs and metrics
+	path        pathPattern
+	kind        string
+	olderThan   time.Duration
+	newerThan   time.Duration
+	largerThan  int64
+	smallerThan int64
+}
+
+// ruleSpec is the YAML form of a rule.
+type ruleSpec struct {
+	Path        string `yaml:"path"`
+	Kind        string `yaml:"kind"`
+	OlderThan   string `yaml:"older-than"`
+	NewerThan   string `yaml:"newer-than"`
+	LargerThan  string `yaml:"larger-than"`
+	SmallerThan string `yaml:"smaller-than"`
+}
+
+// rulesFile is the YAML form of Rules.
+type rulesFile struct {
+	Keep     []ruleSpec `yaml:"keep"`
+	TTL      []ruleSpec `yaml:"ttl"`
+	Priority []struct {
+		ruleSpec `yaml:",inline"`
+		Weight   float64 `yaml:"weight"`
+	} `yaml:"priority"`
+}
+
+// compile checks the conditions of spec.
+func (spec ruleSpec) compile() (rule, error) {
+	var r rule
+	var conds []string
+	var err error
+	if spec.Path != "" {
+		if r.path, err = parsePathPattern(spec.Path); err != nil {
+			return r, fmt.Errorf("invalid path %q: %w", spec.Path, err)
+		}
+		conds = append(conds, "path="+spec.Path)
+	}
+	if spec.Kind != "" {
+		if spec.Kind != kindAC && spec.Kind != kindCAS {
+			return r, fmt.Errorf("invalid kind %q, want %s or %s", spec.Kind, kindAC, kindCAS)
+		}
+		r.kind = spec.Kind
+		conds = append(conds, "kind="+spec.Kind)
+	}
+	for _, d := range []struct {
+		name string
+		src  string
+		dst  *time.Duration
+	}{{"older-than", spec.OlderThan, &r.olderThan}, {"newer-than", spec.NewerThan, &r.newerThan}} {
+		if d.src == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.src); err != nil || *d.dst <= 0 {
+			return r, fmt.Errorf("invalid %s %q", d.name, d.src)
+		}
+		conds = append(conds, d.name+"="+d.src)
+	}
+	for _, b := range []struct {
+		name string
+		src  string
+		dst  *int64
+	}{{"larger-than", spec.LargerThan, &r.largerThan}, {"smaller-than", spec.SmallerThan, &r.smallerThan}} {
+		if b.src == "" {
+			continue
+		}
+		if *b.dst, err = ParseBytes(b.src); err != nil {
+			return r, fmt.Errorf("invalid %s: %w", b.name, err)
+		}
+		conds = append(conds, b.name+"="+b.src)
+	}
+	if len(conds) == 0 {
+		return r, errors.New("a rule needs a condition")
+	}
+	r.src = strings.Join(conds, " ")
+	return r, nil
+}
+
+// match reports whether e meets all the conditions of r at now.
+func (r rule) match(e Entry, now time.Time) bool {
+	age := now.Sub(e.Atime)
+	return r.path.match(e.Key) &&
+		(r.kind == "" || r.kind == e.Kind) &&
+		(r.olderThan == 0 || age > r.olderThan) &&
+		(r.newerThan == 0 || age < r.newerThan) &&
+		(r.largerThan == 0 || e.Size > r.largerThan) &&
+		(r.smallerThan == 0 || e.Size < r.smallerThan)
+}
+
+// String returns the conditions of r.
+func (r rule) String() string {
+	return r.src
+}
+
+// ParseRules parses the rules in data.
+func ParseRules(data []byte) (*Rules, error) {
+	var file rulesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	r := &Rules{}
+	for _, spec := range file.Keep {
+		rule, err := spec.compile()
+		if err != nil {
+			return nil, fmt.Errorf("keep: %w", err)
+		}
+		r.keep = append(r.keep, rule)
+	}
+	for _, spec := range file.TTL {
+		rule, err := spec.compile()
+		if err != nil {
+			return nil, fmt.Errorf("ttl: %w", err)
+		}
+		r.ttl = append(r.ttl, rule)
+	}
+	for _, p := range file.Priority {
+		rule, err := p.compile()
+		if err != nil {
+			return nil, fmt.Errorf("priority: %w", err)
+		}
+		if p.Weight <= 0 {
+			return nil, fmt.Errorf("priority: %q needs a positive weight", rule)
+		}
+		r.priority = append(r.priority, priorityRule{rule: rule, weight: p.Weight})
+	}
+	return r, nil
+}
+
+// LoadRules reads and parses the rules file at path.
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// String summarizes the rules.
+func (r *Rules) String() string {
+	return fmt.Sprintf("%d keep, %d ttl and %d priority rules", len(r.keep), len(r.ttl), len(r.priority))
+}
+
+// Entry holds the attributes rules are evaluated on.
+type Entry struct {
+	Key       string    `json:"key"`
+	Workspace string    `json:"workspace"`
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	Atime     time.Time `json:"atime"`
+	Hotness   uint32    `json:"hotness"`
+}
+
+// NewEntry returns the attributes of the entry with the given key.
+func NewEntry(key string, info diskutil.EntryInfo) Entry {
+	workspace, _, _ := strings.Cut(key, "/")
+	return Entry{
+		Key:       key,
+		Workspace: workspace,
+		Kind:      entryKind(key),
+		Size:      info.Size,
+		Atime:     info.LastAccess,
+	}
+}
+
+// Decision is the outcome of the rules for an entry.
+type Decision struct {
+	Keep     bool    `json:"keep"`
+	TTL      string  `json:"ttl,omitempty"` // The matching ttl rule
+	Priority float64 `json:"priority"`
+}
+
+// Decide evaluates all the rules for e.
+func (r *Rules) Decide(e Entry, now time.Time) Decision {
+	return Decision{Keep: r.Keep(e, now), TTL: r.Expired(e, now), Priority: r.Priority(e, now)}
+}
+
+// Keep reports whether a keep rule matches e.
+func (r *Rules) Keep(e Entry, now time.Time) bool {
+	for _, rule := range r.keep {
+		if rule.match(e, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns the first ttl rule matching e, or "" if there is none.
+func (r *Rules) Expired(e Entry, now time.Time) string {
+	for _, rule := range r.ttl {
+		if rule.match(e, now) {
+			return rule.String()
+		}
+	}
+	return ""
+}
+
+// Priority returns the product of the weights of the priority rules
+// matching e.
+func (r *Rules) Priority(e Entry, now time.Time) float64 {
+	weight := 1.0
+	for _, p := range r.priority {
+		if p.match(e, now) {
+			weight *= p.weight
+		}
+	}
+	return weight
+}
+
+// rulesCheckInterval bounds how often the rules file is checked for
+// changes, it is consulted for every entry eviction looks at.
+const rulesCheckInterval = 10 * time.Second
+
+// rulesLoader reloads a rules file when it changes, a file that fails to
+// load keeps the previous rules in place.
+type rulesLoader struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	rules   *Rules
+}
+
+// current returns the rules, nil if there are none.
+func (l *rulesLoader) current() *Rules {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.checked) < rulesCheckInterval {
+		return l.rules
+	}
+	l.checked = now
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		logrus.WithError(err).WithField("rules", l.path).Error("Failed to check rules")
+		return l.rules
+	}
+	if fi.ModTime().Equal(l.modTime) {
+		return l.rules
+	}
+	rules, err := LoadRules(l.path)
+	if err != nil {
+		promMetrics.RulesReloads.WithLabelValues(l.path, "error").Inc()
+		logrus.WithError(err).WithField("rules", l.path).Error("Failed to reload rules, keeping the previous ones")
+		return l.rules
+	}
+	promMetrics.RulesReloads.WithLabelValues(l.path, "success").Inc()
+	logrus.WithField("rules", l.path).Infof("loaded %s", rules)
+	l.modTime = fi.ModTime()
+	l.rules = rules
+	return l.rules
+}
+
+// entry returns the attributes of entry for the rules.
+func (n *Notify) entry(info diskutil.EntryInfo) Entry {
+	e := NewEntry(n.disk.PathToKey(info.Path), info)
+	if n.heavykeeper != nil {
+		e.Hotness = n.heavykeeper.Query(info.Path)
+	}
+	return e
+}
@@ -0,0 +1,129 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+keep:
+  - path: release
+ttl:
+  - kind: ac
+    older-than: 72h
+  - path: pr-*
+    larger-than: 1K
+priority:
+  - path: regex:^pr-
+    weight: 0.5
+  - kind: cas
+    weight: 3
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	require.NoError(t, err)
+	require.Equal(t, "1 keep, 2 ttl and 2 priority rules", rules.String())
+
+	rules, err = ParseRules(nil)
+	require.NoError(t, err)
+	require.Equal(t, "0 keep, 0 ttl and 0 priority rules", rules.String())
+
+	for _, bad := range []string{
+		"keep: [{}]",                         // No condition
+		"keep: [{owner: me}]",                // Unknown condition
+		"keep: [{kind: tree}]",               // Unknown kind
+		"keep: [{path: 'regex:('}]",          // Invalid regex
+		"ttl: [{older-than: 3d}]",            // Invalid duration
+		"ttl: [{newer-than: -1h}]",           // Negative duration
+		"keep: [{larger-than: 1X}]",          // Invalid byte count
+		"priority: [{kind: ac}]",             // No weight
+		"priority: [{kind: ac, weight: -1}]", // Negative weight
+		"evict: [{kind: ac}]",                // Unknown section
+		"keep: {path: release}",              // Not a list
+	} {
+		_, err := ParseRules([]byte(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestRulesDecide(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	require.NoError(t, err)
+	now := time.Now()
+	entry := func(key string, age time.Duration, size int64) Entry {
+		return NewEntry(key, diskutil.EntryInfo{LastAccess: now.Add(-age), Size: size})
+	}
+	for _, c := range []struct {
+		entry Entry
+		want  Decision
+	}{
+		{entry("release/ac/ab", 100*time.Hour, 10), Decision{Keep: true, TTL: "kind=ac older-than=72h", Priority: 1}},
+		{entry("main/ac/ab", time.Hour, 10), Decision{Priority: 1}},
+		{entry("main/cas/ab", time.Hour, 10), Decision{Priority: 3}},
+		{entry("pr-1/cas/ab", time.Hour, 2048), Decision{TTL: "path=pr-* larger-than=1K", Priority: 1.5}},
+		{entry("pr-1/cas/cd", time.Hour, 1024), Decision{Priority: 1.5}},
+	} {
+		require.Equal(t, c.want, rules.Decide(c.entry, now), c.entry.Key)
+	}
+
+	// every condition of a rule has to match
+	rules, err = ParseRules([]byte(`
+keep:
+  - path: prefix:main/cas/
+    newer-than: 24h
+    smaller-than: 1M
+`))
+	require.NoError(t, err)
+	require.True(t, rules.Keep(entry("main/cas/ab", time.Hour, 10), now))
+	require.False(t, rules.Keep(entry("main/cas/ab", 48*time.Hour, 10), now))
+	require.False(t, rules.Keep(entry("main/cas/ab", time.Hour, 2<<20), now))
+	require.False(t, rules.Keep(entry("main/ac/ab", time.Hour, 10), now))
+}
+
+func TestRulesEviction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testRules), 0644))
+	now := time.Now()
+	cases := []struct {
+		key    string
+		age    time.Duration
+		remove bool
+	}{
+		{"release/ac/ab", 100 * time.Hour, false},
+		{"main/ac/ab", 100 * time.Hour, true},
+		{"main/ac/cd", time.Hour, false},
+		{"main/cas/ab", 100 * time.Hour, false},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, c.key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+		at := now.Add(-c.age)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false)}
+	WithRules(path)(n)
+	require.Equal(t, reasonRule, n.newGuard(triggerManual).protect(diskutil.EntryInfo{Path: filepath.Join(dir, "release/ac/ab")}))
+	n.expire(now)
+	for _, c := range cases {
+		_, err := os.Stat(filepath.Join(dir, c.key))
+		require.Equal(t, c.remove, os.IsNotExist(err), c.key)
+	}
+
+	// a broken file keeps the previous rules
+	require.NoError(t, os.WriteFile(path, []byte("keep: [{size: 1K}]"), 0644))
+	n.rules.checked = time.Time{}
+	n.rules.modTime = time.Time{}
+	require.Equal(t, "1 keep, 2 ttl and 2 priority rules", n.rules.current().String())
+	require.NoError(t, os.WriteFile(path, []byte("keep: [{kind: cas}]"), 0644))
+	n.rules.checked = time.Time{}
+	n.rules.modTime = time.Time{}
+	require.Equal(t, "1 keep, 0 ttl and 0 priority rules", n.rules.current().String())
+}
@@ -0,0 +1,133 @@
+package eviction
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+)
+
+// ClassWeights are the weights of the priority classes, e.g. main-ci=4,
+// pr-ci=2 and developer=1. The score of an entry is multiplied by the
+// weight of its class, entries outside of any class weigh 1.
+//
+// ClassWeights implements flag.Value, each Set adds one NAME=WEIGHT class.
+type ClassWeights map[string]float64
+
+// String implements flag.Value.
+func (c *ClassWeights) String() string {
+	if c == nil {
+		return ""
+	}
+	classes := make([]string, 0, len(*c))
+	for name, weight := range *c {
+		classes = append(classes, name+"="+strconv.FormatFloat(weight, 'g', -1, 64))
+	}
+	sort.Strings(classes)
+	return strings.Join(classes, " ")
+}
+
+// Set implements flag.Value.
+func (c *ClassWeights) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid class %q: want NAME=WEIGHT", s)
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || weight <= 0 {
+		return fmt.Errorf("invalid class %q: want a positive weight", s)
+	}
+	if *c == nil {
+		*c = make(ClassWeights)
+	}
+	(*c)[name] = weight
+	return nil
+}
+
+// ClassRules assign cache entries to priority classes, a rule is written
+// as PATTERN=CLASS with the patterns of PinRules, e.g. main=main-ci or
+// pr-*=pr-ci, and the first matching rule wins.
+//
+// ClassRules implements flag.Value, each Set appends one rule.
+type ClassRules []classRule
+
+type classRule struct {
+	pattern pathPattern
+	class   string
+}
+
+// String implements flag.Value.
+func (c *ClassRules) String() string {
+	if c == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(*c))
+	for _, rule := range *c {
+		rules = append(rules, rule.pattern.String()+"="+rule.class)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Set implements flag.Value.
+func (c *ClassRules) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 || i == len(s)-1 {
+		return fmt.Errorf("invalid class rule %q: want PATTERN=CLASS", s)
+	}
+	pattern, err := parsePathPattern(s[:i])
+	if err != nil {
+		return fmt.Errorf("invalid class rule %q: %w", s, err)
+	}
+	*c = append(*c, classRule{pattern: pattern, class: s[i+1:]})
+	return nil
+}
+
+// class returns the class of key, relative to the cache dir, or "".
+func (c ClassRules) class(key string) string {
+	for _, rule := range c {
+		if rule.pattern.match(key) {
+			return rule.class
+		}
+	}
+	return ""
+}
+
+// Classes combines the priority classes with the rules assigning entries
+// to them.
+type Classes struct {
+	Weights ClassWeights
+	Rules   ClassRules
+}
+
+// weight returns the class weight of key, relative to the cache dir.
+func (c Classes) weight(key string) float64 {
+	if weight, ok := c.Weights[c.Rules.class(key)]; ok {
+		return weight
+	}
+	return 1
+}
+
+// score rates how much keeping entry is worth, eviction deletes the lowest
+// scores first. It grows with the recency of the last access and with the
+// top-k estimate of the accesses, shrinks with the size (so that a large
+// file goes before several small ones that are used as much) and is
+// scaled by the weight of the entry's priority class and by its priority
+// rules.
+func (n *Notify) score(entry diskutil.EntryInfo, now time.Time) float64 {
+	age := now.Sub(entry.LastAccess).Hours()
+	if age < 0 {
+		age = 0
+	}
+	recency := 1 / (1 + age)
+	frequency := 1 + math.Log2(1+float64(n.heavykeeper.Query(entry.Path)))
+	size := 1 + math.Log2(1+float64(entry.Size)/(1<<20))
+	score := n.classes.weight(n.disk.PathToKey(entry.Path)) * recency * frequency / size
+	if rules := n.rules.current(); rules != nil {
+		score *= rules.Priority(n.entry(entry), now)
+	}
+	return score
+}
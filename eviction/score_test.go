@@ -0,0 +1,45 @@
+package eviction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/heavykeeper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScore(t *testing.T) {
+	var classes Classes
+	require.NoError(t, classes.Weights.Set("main-ci=4"))
+	require.NoError(t, classes.Weights.Set("developer=0.5"))
+	require.Error(t, classes.Weights.Set("pr-ci=0"))
+	require.NoError(t, classes.Rules.Set("main=main-ci"))
+	require.NoError(t, classes.Rules.Set("prefix:dev-=developer"))
+	require.Error(t, classes.Rules.Set("main"))
+	require.Equal(t, "glob:main=main-ci prefix:dev-=developer", classes.Rules.String())
+
+	n := &Notify{
+		disk:        diskutil.NewCache("/cache"),
+		heavykeeper: heavykeeper.NewHeavyKeeper(10, 100, 4, 0.9, 1),
+		classes:     classes,
+	}
+	now := time.Now()
+	entry := func(key string, age time.Duration, size int64) diskutil.EntryInfo {
+		return diskutil.EntryInfo{Path: "/cache/" + key, LastAccess: now.Add(-age), Size: size}
+	}
+	score := func(e diskutil.EntryInfo) float64 {
+		return n.score(e, now)
+	}
+
+	// recency
+	require.Less(t, score(entry("pr/cas/a", 2*time.Hour, 10)), score(entry("pr/cas/a", time.Hour, 10)))
+	// size
+	require.Less(t, score(entry("pr/cas/a", time.Hour, 100<<20)), score(entry("pr/cas/a", time.Hour, 10)))
+	// frequency
+	n.heavykeeper.Add("/cache/pr/cas/hot", 100)
+	require.Less(t, score(entry("pr/cas/a", time.Hour, 10)), score(entry("pr/cas/hot", time.Hour, 10)))
+	// class
+	require.Less(t, score(entry("dev-1/cas/a", time.Hour, 10)), score(entry("pr/cas/a", time.Hour, 10)))
+	require.Less(t, score(entry("pr/cas/a", time.Hour, 10)), score(entry("main/cas/a", time.Hour, 10)))
+}
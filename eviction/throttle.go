@@ -0,0 +1,140 @@
+package eviction
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// maxOpenDirs is how many directories a pass keeps open to delete the
+// entries they hold.
+const maxOpenDirs = 512
+
+// throttle paces deletions so that a big eviction pass doesn't starve the
+// builds using the same disk, see WithRateLimit. It is shared by every
+// eviction path.
+type throttle struct {
+	mu    sync.Mutex
+	files bucket
+	bytes bucket
+	sleep func(time.Duration)
+}
+
+func newThrottle(files, bytes float64) *throttle {
+	if files <= 0 && bytes <= 0 {
+		return nil
+	}
+	return &throttle{files: bucket{rate: files}, bytes: bucket{rate: bytes}, sleep: time.Sleep}
+}
+
+// wait blocks until a deletion of size bytes fits in the rate limit, it
+// returns how long it waited. A nil throttle never waits.
+func (t *throttle) wait(size int64) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	now := time.Now()
+	d := t.files.take(1, now)
+	if b := t.bytes.take(float64(size), now); b > d {
+		d = b
+	}
+	t.mu.Unlock()
+	if d > 0 {
+		t.sleep(d)
+	}
+	return d
+}
+
+// bucket is a token bucket refilled with rate tokens a second, holding at
+// most a second worth of them. A take larger than what it holds leaves it
+// in debt, which the caller waits out.
+type bucket struct {
+	rate   float64 // Zero is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens at now and returns how long until the bucket is
+// out of debt.
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// pace runs before every deletion of g: it waits for the rate limit and
+// moves the pass to the idle IO class if configured, until close. An
+// emergency pass goes at full speed.
+func (g *guard) pace(size int64) {
+	if g.emergency {
+		return
+	}
+	if g.n.idleIO && !g.idle {
+		g.ioprio, g.idle = setIdleIO()
+	}
+	if d := g.n.throttle.wait(size); d > 0 {
+		promMetrics.ThrottledSeconds.WithLabelValues(g.n.path).Add(d.Seconds())
+	}
+}
+
+// close releases what the deletions of g held: the directories kept open
+// and the IO priority.
+func (g *guard) close() {
+	if g.deleter != nil {
+		g.deleter.Close()
+		g.deleter = nil
+	}
+	if g.idle {
+		restoreIO(g.ioprio)
+		g.idle = false
+	}
+}
+
+// see ioprio_set(2)
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassIdle  = 3
+)
+
+// setIdleIO locks the calling goroutine to its thread and moves the thread
+// to the idle IO class, it only gets disk time when no one else wants it.
+// It returns the previous priority, for restoreIO, and whether it did.
+func setIdleIO() (int, bool) {
+	runtime.LockOSThread()
+	prio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno == 0 {
+		_, _, errno = unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+	}
+	if errno != 0 {
+		runtime.UnlockOSThread()
+		logrus.WithError(errno).Warn("Failed to set the idle IO class")
+		return 0, false
+	}
+	return int(prio), true
+}
+
+// restoreIO undoes setIdleIO.
+func restoreIO(prio int) {
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		// keep the thread rather than handing its IO class to other goroutines
+		logrus.WithError(errno).Warn("Failed to restore the IO priority")
+		return
+	}
+	runtime.UnlockOSThread()
+}
@@ -0,0 +1,48 @@
+package eviction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := bucket{rate: 10}
+	for i := 0; i < 10; i++ {
+		require.Zero(t, b.take(1, now), i)
+	}
+	require.Equal(t, 100*time.Millisecond, b.take(1, now))
+	// refilled, the debt is paid first
+	require.Zero(t, b.take(1, now.Add(200*time.Millisecond)))
+	// never more than a second worth
+	require.Equal(t, time.Second, b.take(20, now.Add(time.Hour)))
+
+	unlimited := bucket{}
+	require.Zero(t, unlimited.take(1e9, now))
+}
+
+func TestThrottle(t *testing.T) {
+	require.Nil(t, newThrottle(0, 0))
+	require.Zero(t, (*throttle)(nil).wait(1<<30))
+
+	th := newThrottle(0, 100)
+	var slept time.Duration
+	th.sleep = func(d time.Duration) { slept += d }
+	require.Zero(t, th.wait(100))
+	d := th.wait(200)
+	require.InDelta(t, float64(2*time.Second), float64(d), float64(10*time.Millisecond))
+	require.Equal(t, d, slept)
+}
+
+func TestIdleIO(t *testing.T) {
+	prio, ok := setIdleIO()
+	if !ok {
+		t.Skip("ioprio_set is not permitted")
+	}
+	current, _, _ := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	restoreIO(prio)
+	require.EqualValues(t, ioprioClassIdle, current>>ioprioClassShift)
+}
@@ -1,35 +1,187 @@
 package eviction
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// errUnmapped is returned by transfer.tran for paths no rule maps into the cache dir.
+var errUnmapped = errors.New("path is not mapped into the cache dir")
+
+// PathMapping is an ordered list of rules mapping paths beneath the listen
+// dir to cache keys beneath the cache dir, the first rule that matches wins.
+//
+// Rules are written as
+//
+//	strip:N          drop the first N path segments (e.g. the diskN mount)
+//	regex:RE=>TMPL   match RE against the relative path and expand TMPL ($1, ${name})
+//	identity         keep the relative path as is
+//
+// PathMapping implements flag.Value, each Set appends one rule.
+type PathMapping []mappingRule
+
+// DefaultPathMapping drops the disk directory the cache is mounted on.
+var DefaultPathMapping = PathMapping{stripRule(1)}
+
+type mappingRule interface {
+	// apply maps a clean path relative to the listen dir to a path
+	// relative to the cache dir.
+	apply(rel string) (string, bool)
+	String() string
+}
+
+// String implements flag.Value.
+func (m *PathMapping) String() string {
+	if m == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(*m))
+	for _, rule := range *m {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+// Set implements flag.Value.
+func (m *PathMapping) Set(s string) error {
+	rule, err := parseMappingRule(s)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, rule)
+	return nil
+}
+
+func parseMappingRule(s string) (mappingRule, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "identity":
+		return identityRule{}, nil
+	case "strip":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid rule %q: strip needs a non-negative segment count", s)
+		}
+		return stripRule(n), nil
+	case "regex":
+		expr, template, ok := strings.Cut(arg, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q: want regex:RE=>TEMPLATE", s)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", s, err)
+		}
+		if err := checkTemplate(re, template); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", s, err)
+		}
+		return regexRule{re: re, template: template}, nil
+	}
+	return nil, fmt.Errorf("unknown rule %q", s)
+}
+
+// templateRef matches the references regexp.Expand understands.
+var templateRef = regexp.MustCompile(`\$(\$|\{(\w+)\}|(\w+))`)
+
+// checkTemplate makes sure every group referenced by template exists in re,
+// regexp.Expand silently replaces unknown groups with nothing.
+func checkTemplate(re *regexp.Regexp, template string) error {
+	names := make(map[string]bool)
+	for i, name := range re.SubexpNames() {
+		names[strconv.Itoa(i)] = true
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for _, ref := range templateRef.FindAllStringSubmatch(template, -1) {
+		name := ref[2] + ref[3]
+		if name != "" && !names[name] {
+			return fmt.Errorf("template references unknown group %q", name)
+		}
+	}
+	return nil
+}
+
+type stripRule int
+
+func (r stripRule) apply(rel string) (string, bool) {
+	segments := strings.Split(rel, "/")
+	if len(segments) <= int(r) {
+		return "", false
+	}
+	return filepath.Join(segments[r:]...), true
+}
+
+func (r stripRule) String() string {
+	return "strip:" + strconv.Itoa(int(r))
+}
+
+type regexRule struct {
+	re       *regexp.Regexp
+	template string
+}
+
+func (r regexRule) apply(rel string) (string, bool) {
+	match := r.re.FindStringSubmatchIndex(rel)
+	if match == nil {
+		return "", false
+	}
+	return string(r.re.ExpandString(nil, r.template, rel, match)), true
+}
+
+func (r regexRule) String() string {
+	return "regex:" + r.re.String() + "=>" + r.template
+}
+
+type identityRule struct{}
+
+func (identityRule) apply(rel string) (string, bool) {
+	return rel, true
+}
+
+func (identityRule) String() string {
+	return "identity"
+}
+
 type transfer struct {
 	listenDir string
 	cacheDir  string
+	mapping   PathMapping
 }
 
 func newTransfer(listenDir, cacheDir string) *transfer {
 	return &transfer{
 		listenDir: listenDir,
 		cacheDir:  cacheDir,
+		mapping:   DefaultPathMapping,
 	}
 }
 
+// tran maps a watched path to its cache key, it returns errUnmapped for
+// paths outside of the listen dir, paths no rule matches and paths that
+// would land outside of the cache dir.
 func (t *transfer) tran(listenDir string) (string, error) {
 	base, err := filepath.Rel(t.listenDir, listenDir)
 	if err != nil {
 		return "", err
 	}
-	pathList := strings.Split(base, "/")
-	idx := 0
-	for n := 0; n < len(pathList); n++ {
-		if n == 1 {
-			idx = n
-			break
+	if base == ".." || strings.HasPrefix(base, "../") {
+		return "", errUnmapped
+	}
+	for _, rule := range t.mapping {
+		rel, ok := rule.apply(base)
+		if !ok {
+			continue
+		}
+		rel = filepath.Clean(rel)
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || filepath.IsAbs(rel) {
+			return "", errUnmapped
 		}
+		return filepath.Join(t.cacheDir, rel), nil
 	}
-	pathList = pathList[idx:]
-	return filepath.Join(t.cacheDir, filepath.Join(pathList...)), nil
+	return "", errUnmapped
 }
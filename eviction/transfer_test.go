@@ -12,3 +12,37 @@ func TestTransfer(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, actual, "/data1/bazel/cache/2c389379-351c-4b6d-a402-ad03b7b7d449")
 }
+
+func TestTransferMapping(t *testing.T) {
+	var mapping PathMapping
+	require.NoError(t, mapping.Set(`regex:^disk\d+/(?P<ws>[^/]+)/v2/(.*)$=>${ws}/$2`))
+	require.NoError(t, mapping.Set("strip:2"))
+	tran := newTransfer("/mnt/kubernetes-disks-bazel", "/data1/bazel/cache")
+	tran.mapping = mapping
+
+	for _, c := range []struct {
+		path     string
+		expected string
+	}{
+		{"/mnt/kubernetes-disks-bazel/disk1/ws/v2/cas/ab", "/data1/bazel/cache/ws/cas/ab"},
+		{"/mnt/kubernetes-disks-bazel/disk1/ws/cas/ab", "/data1/bazel/cache/cas/ab"},
+	} {
+		actual, err := tran.tran(c.path)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, actual)
+	}
+	for _, path := range []string{
+		"/mnt/kubernetes-disks-bazel/disk1/ws",
+		"/mnt/other/disk1/ws/cas/ab",
+		"/mnt/kubernetes-disks-bazel/disk1/ws/v2/../../../..",
+	} {
+		_, err := tran.tran(path)
+		require.ErrorIs(t, err, errUnmapped, path)
+	}
+
+	require.Error(t, mapping.Set("strip:-1"))
+	require.Error(t, mapping.Set("regex:(a)=>$2"))
+	require.Error(t, mapping.Set("regex:(=>$1"))
+	require.Error(t, mapping.Set("rewrite:a"))
+	require.Equal(t, `regex:^disk\d+/(?P<ws>[^/]+)/v2/(.*)$=>${ws}/$2 strip:2`, mapping.String())
+}
@@ -0,0 +1,285 @@
+package eviction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// trashBatchLayout names the directories of the trash holding the entries
+// of one eviction pass, by the start of the pass.
+const trashBatchLayout = "20060102T150405.000000000Z"
+
+// trash holds evicted entries for a while before they are purged, so that
+// an eviction going wrong can be undone, see WithTrash. Entries are renamed
+// into the trash dir at the top of the mount holding them within the cache
+// dir, as .trash/BATCH/KEY.
+type trash struct {
+	delay time.Duration
+
+	mu    sync.Mutex
+	roots map[uint64]string // Directory holding the trash dir, by device
+	bytes map[uint64]int64  // Bytes in the trash, by device
+}
+
+func newTrash(delay time.Duration) *trash {
+	return &trash{
+		delay: delay,
+		roots: make(map[uint64]string),
+		bytes: make(map[uint64]int64),
+	}
+}
+
+// inTrash reports whether path lies in a trash dir.
+func inTrash(path string) bool {
+	for _, segment := range strings.Split(path, string(os.PathSeparator)) {
+		if segment == diskutil.TrashDir {
+			return true
+		}
+	}
+	return false
+}
+
+// trashBytes returns the bytes in the trash of the device dev, zero
+// without a trash.
+func (n *Notify) trashBytes(dev uint64) int64 {
+	if n.trash == nil {
+		return 0
+	}
+	n.trash.mu.Lock()
+	defer n.trash.mu.Unlock()
+	return n.trash.bytes[dev]
+}
+
+// trashRoot returns the directory holding the trash dir for the entries of
+// the device dev, the deepest mount point within the cache dir holding path
+// or the cache dir itself. A rename can't cross mount points.
+func (n *Notify) trashRoot(dev uint64, path string) string {
+	t := n.trash
+	t.mu.Lock()
+	root, ok := t.roots[dev]
+	t.mu.Unlock()
+	if ok {
+		return root
+	}
+	root = n.path
+	for point := range n.mountPoints() {
+		if beneath(point, n.path) && beneath(path, point) && len(point) > len(root) {
+			root = point
+		}
+	}
+	t.mu.Lock()
+	t.roots[dev] = root
+	t.mu.Unlock()
+	return root
+}
+
+// moveToTrash renames the entry into the trash batch of g. An entry that
+// can't be renamed there is kept rather than deleted without an undo.
+func (n *Notify) moveToTrash(g *guard, entry diskutil.EntryInfo) error {
+	key := n.disk.PathToKey(entry.Path)
+	root := n.trashRoot(entry.Dev, entry.Path)
+	dst := filepath.Join(root, diskutil.TrashDir, g.start.UTC().Format(trashBatchLayout), key)
+	err := n.disk.Rename(key, n.disk.PathToKey(dst))
+	if errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("trash %s is on another filesystem: %w", root, err)
+	}
+	if err != nil {
+		return err
+	}
+	n.trash.mu.Lock()
+	n.trash.bytes[entry.Dev] += entry.Size
+	n.trash.mu.Unlock()
+	promMetrics.TrashBytes.WithLabelValues(n.path).Add(float64(entry.Size))
+	return nil
+}
+
+// trashBatch is a directory of a trash dir.
+type trashBatch struct {
+	dev  uint64
+	dir  string
+	time time.Time
+}
+
+// loadTrash finds the trash dirs left by earlier runs and accounts for
+// their contents.
+func (n *Notify) loadTrash() {
+	roots := n.cacheMounts()
+	t := n.trash
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total int64
+	for _, root := range roots {
+		fi, err := os.Stat(filepath.Join(root, diskutil.TrashDir))
+		if err != nil {
+			continue
+		}
+		dev := diskutil.GetDev(fi)
+		t.roots[dev] = root
+		t.bytes[dev] = dirSize(filepath.Join(root, diskutil.TrashDir))
+		total += t.bytes[dev]
+	}
+	promMetrics.TrashBytes.WithLabelValues(n.path).Set(float64(total))
+}
+
+// batches lists the trash batches, t.mu is held.
+func (t *trash) batches() []trashBatch {
+	var batches []trashBatch
+	for dev, root := range t.roots {
+		dir := filepath.Join(root, diskutil.TrashDir)
+		names, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logrus.WithError(err).WithField("trash", dir).Error("Failed to list trash")
+			}
+			continue
+		}
+		for _, name := range names {
+			at, err := time.Parse(trashBatchLayout, name.Name())
+			if err != nil {
+				logrus.WithField("trash", dir).Warnf("ignoring %s", name.Name())
+				continue
+			}
+			batches = append(batches, trashBatch{dev: dev, dir: filepath.Join(dir, name.Name()), time: at})
+		}
+	}
+	return batches
+}
+
+// purgeLoop purges the trash batches older than the delay every interval
+// until ctx is done.
+func (n *Notify) purgeLoop(ctx context.Context, interval time.Duration) {
+	n.loadTrash()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.purgeTrash("expired", func(b trashBatch) bool {
+				return now.Sub(b.time) >= n.trash.delay
+			})
+		}
+	}
+}
+
+// purgeTrash deletes the trash batches matching purge, reason labels the
+// purged bytes. In dry-run mode it only logs what it would purge.
+func (n *Notify) purgeTrash(reason string, purge func(trashBatch) bool) {
+	t := n.trash
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var purged int64
+	for _, b := range t.batches() {
+		if !purge(b) {
+			continue
+		}
+		size := dirSize(b.dir)
+		if n.dryRun {
+			logrus.WithField("trash", b.dir).WithField("reason", reason).WithField("dry-run", true).Infof("would purge %d bytes from the trash", size)
+			continue
+		}
+		if err := n.disk.RemoveAll(n.disk.PathToKey(b.dir)); err != nil {
+			logrus.WithError(err).WithField("trash", b.dir).Error("Failed to purge trash")
+			size -= dirSize(b.dir)
+		}
+		t.bytes[b.dev] -= size
+		purged += size
+	}
+	if purged > 0 {
+		logrus.WithField("dir", n.path).WithField("reason", reason).Infof("purged %d bytes from the trash", purged)
+		promMetrics.TrashBytes.WithLabelValues(n.path).Sub(float64(purged))
+		promMetrics.TrashPurgedBytes.WithLabelValues(n.path, reason).Add(float64(purged))
+	}
+}
+
+// RestoreFilter selects the trash contents to restore, zero fields match
+// everything.
+type RestoreFilter struct {
+	Workspace string
+	Since     time.Time // Evicted at or after
+	Until     time.Time // Evicted before
+}
+
+func (f RestoreFilter) matchBatch(b trashBatch) bool {
+	return (f.Since.IsZero() || !b.time.Before(f.Since)) && (f.Until.IsZero() || b.time.Before(f.Until))
+}
+
+// Restore moves the trash contents selected by f back into the cache, an
+// entry that was written again since it was evicted is left in the trash.
+// It returns the number of files and bytes restored.
+func (n *Notify) Restore(f RestoreFilter) (files int, bytes int64, err error) {
+	if n.trash == nil {
+		return 0, 0, errors.New("the trash is disabled")
+	}
+	t := n.trash
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.batches() {
+		if !f.matchBatch(b) {
+			continue
+		}
+		walkErr := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			key, err := filepath.Rel(b.dir, path)
+			if err != nil {
+				return err
+			}
+			if workspace, _, _ := strings.Cut(key, "/"); f.Workspace != "" && workspace != f.Workspace {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := n.disk.Rename(n.disk.PathToKey(path), key); errors.Is(err, fs.ErrExist) {
+				logrus.WithField("key", key).Info("not restoring, the entry was written again")
+				return nil
+			} else if err != nil {
+				return err
+			}
+			files++
+			bytes += info.Size()
+			t.bytes[b.dev] -= info.Size()
+			return nil
+		})
+		if err := n.disk.RemoveEmptyDirs(n.disk.PathToKey(b.dir)); err != nil {
+			logrus.WithError(err).WithField("trash", b.dir).Warn("Failed to remove the emptied trash directories")
+		}
+		if walkErr != nil {
+			err = walkErr
+			break
+		}
+	}
+	promMetrics.TrashBytes.WithLabelValues(n.path).Sub(float64(bytes))
+	logrus.WithField("dir", n.path).Infof("restored %d entries, %d bytes from the trash", files, bytes)
+	return files, bytes, err
+}
+
+// dirSize returns the bytes of the files below dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
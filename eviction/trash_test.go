@@ -0,0 +1,102 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), trash: newTrash(time.Hour)}
+	keys := []string{"pr/cas/a", "pr/cas/b", "main/cas/a"}
+	var entries []diskutil.EntryInfo
+	for _, key := range keys {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		entries = append(entries, diskutil.EntryInfo{Path: path, Size: fi.Size(), Dev: diskutil.GetDev(fi)})
+	}
+	g := n.newGuard(triggerManual)
+	for _, entry := range entries {
+		deleted, _ := n.evict(g, entry, policyScore)
+		require.True(t, deleted)
+	}
+	require.Empty(t, n.disk.GetEntries())
+	batch := filepath.Join(dir, diskutil.TrashDir, g.start.UTC().Format(trashBatchLayout))
+	require.FileExists(t, filepath.Join(batch, "pr/cas/a"))
+	require.EqualValues(t, 15, n.trashBytes(entries[0].Dev))
+
+	// a time range without evictions
+	files, _, err := n.Restore(RestoreFilter{Until: g.start.Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Zero(t, files)
+
+	// pr/cas/b is written again, it stays in the trash
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pr/cas/b"), []byte("new"), 0644))
+	files, bytes, err := n.Restore(RestoreFilter{Workspace: "pr", Since: g.start})
+	require.NoError(t, err)
+	require.Equal(t, 1, files)
+	require.EqualValues(t, 5, bytes)
+	require.FileExists(t, filepath.Join(dir, "pr/cas/a"))
+	require.NoFileExists(t, filepath.Join(batch, "pr/cas/a"))
+	require.FileExists(t, filepath.Join(batch, "pr/cas/b"))
+
+	// a restart finds what is left
+	n.trash = newTrash(time.Hour)
+	n.loadTrash()
+	require.EqualValues(t, 10, n.trashBytes(entries[0].Dev))
+
+	n.purgeTrash("expired", func(b trashBatch) bool { return time.Since(b.time) >= time.Hour })
+	require.FileExists(t, filepath.Join(batch, "main/cas/a"))
+	// a dry run purges nothing
+	n.dryRun = true
+	n.purgeTrash("pressure", func(b trashBatch) bool { return true })
+	require.FileExists(t, filepath.Join(batch, "main/cas/a"))
+	require.EqualValues(t, 10, n.trashBytes(entries[0].Dev))
+	n.dryRun = false
+	n.purgeTrash("pressure", func(b trashBatch) bool { return true })
+	require.NoDirExists(t, batch)
+	require.Zero(t, n.trashBytes(entries[0].Dev))
+}
+
+func TestTrashMount(t *testing.T) {
+	dir := t.TempDir()
+	disk1 := filepath.Join(dir, "disk1")
+	dev := mountTmpfs(t, disk1)
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), trash: newTrash(time.Hour)}
+	path := filepath.Join(disk1, "ws/cas/a")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+	entry := diskutil.EntryInfo{Path: path, Size: 5, Dev: dev}
+
+	// the trash of the cache dir is on another filesystem, the entry stays
+	g := n.newGuard(triggerManual)
+	n.trash.roots[dev] = dir
+	deleted, _ := n.evict(g, entry, policyScore)
+	require.False(t, deleted)
+	require.FileExists(t, path)
+	require.ErrorIs(t, g.failure(), syscall.EXDEV)
+	n.evict(g, entry, policyScore)
+	require.ErrorContains(t, g.failure(), "and 1 more failures")
+
+	// the trash of the disk is on the disk
+	delete(n.trash.roots, dev)
+	deleted, _ = n.evict(g, entry, policyScore)
+	require.True(t, deleted)
+	batch := filepath.Join(disk1, diskutil.TrashDir, g.start.UTC().Format(trashBatchLayout))
+	require.FileExists(t, filepath.Join(batch, "disk1/ws/cas/a"))
+	require.EqualValues(t, 5, n.trashBytes(dev))
+
+	files, _, err := n.Restore(RestoreFilter{})
+	require.NoError(t, err)
+	require.Equal(t, 1, files)
+	require.FileExists(t, path)
+}
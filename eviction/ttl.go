@@ -0,0 +1,110 @@
+package eviction
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+)
+
+// TTLRules expire the cache entries matching a pattern once they have not
+// been accessed for a while, however much disk is free. A rule is written
+// as PATTERN=DURATION, e.g. glob:pr-*=72h, with the patterns of PinRules;
+// the first matching rule applies. Pinned entries never expire.
+//
+// TTLRules implements flag.Value, each Set appends one rule.
+type TTLRules []ttlRule
+
+type ttlRule struct {
+	pattern pathPattern
+	ttl     time.Duration
+}
+
+// String implements flag.Value.
+func (t *TTLRules) String() string {
+	if t == nil {
+		return ""
+	}
+	rules := make([]string, 0, len(*t))
+	for _, rule := range *t {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+// Set implements flag.Value.
+func (t *TTLRules) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return fmt.Errorf("invalid ttl rule %q: want PATTERN=DURATION", s)
+	}
+	pattern, err := parsePathPattern(s[:i])
+	if err != nil {
+		return fmt.Errorf("invalid ttl rule %q: %w", s, err)
+	}
+	ttl, err := time.ParseDuration(s[i+1:])
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid ttl rule %q: want a positive duration", s)
+	}
+	*t = append(*t, ttlRule{pattern: pattern, ttl: ttl})
+	return nil
+}
+
+// match returns the first rule matching key, relative to the cache dir.
+func (t TTLRules) match(key string) (ttlRule, bool) {
+	for _, rule := range t {
+		if rule.pattern.match(key) {
+			return rule, true
+		}
+	}
+	return ttlRule{}, false
+}
+
+func (r ttlRule) String() string {
+	return r.pattern.String() + "=" + r.ttl.String()
+}
+
+// expireLoop deletes the entries past their TTL every interval until ctx
+// is done.
+func (n *Notify) expireLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.expire(time.Now())
+		}
+	}
+}
+
+// expire deletes the entries that were last accessed longer ago than the
+// TTL of their rule, and those matching a ttl rule of the rules file.
+func (n *Notify) expire(now time.Time) {
+	g := n.newGuard(triggerTTL)
+	g.now = now
+	for _, entry := range n.disk.GetEntries() {
+		rule := n.expiredBy(g.rules, entry, now)
+		if rule == "" {
+			continue
+		}
+		if deleted, _ := n.evict(g, entry, policyTTL); deleted {
+			promMetrics.ExpiredBytes.WithLabelValues(n.path, rule).Add(float64(entry.Size))
+		}
+	}
+	n.finish(g)
+}
+
+// expiredBy returns the TTL rule or rules file ttl rule entry is past, or "".
+func (n *Notify) expiredBy(rules *Rules, entry diskutil.EntryInfo, now time.Time) string {
+	if rule, ok := n.ttls.match(n.disk.PathToKey(entry.Path)); ok && now.Sub(entry.LastAccess) >= rule.ttl {
+		return rule.String()
+	}
+	if rules == nil {
+		return ""
+	}
+	return rules.Expired(n.entry(entry), now)
+}
@@ -0,0 +1,46 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLRules(t *testing.T) {
+	var ttls TTLRules
+	require.NoError(t, ttls.Set("glob:pr-*=72h"))
+	require.NoError(t, ttls.Set("prefix:tmp=1h"))
+	require.Error(t, ttls.Set("pr-*"))
+	require.Error(t, ttls.Set("pr-*=-1h"))
+	require.Equal(t, "glob:pr-*=72h0m0s prefix:tmp=1h0m0s", ttls.String())
+
+	dir := t.TempDir()
+	now := time.Now()
+	cases := []struct {
+		key    string
+		age    time.Duration
+		remove bool
+	}{
+		{"pr-1/cas/old", 73 * time.Hour, true},
+		{"pr-1/cas/new", 71 * time.Hour, false},
+		{"main/cas/old", 100 * time.Hour, false},
+		{"tmpfile", 2 * time.Hour, true},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, c.key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("entry"), 0644))
+		at := now.Add(-c.age)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), ttls: ttls}
+	n.expire(now)
+	for _, c := range cases {
+		_, err := os.Stat(filepath.Join(dir, c.key))
+		require.Equal(t, c.remove, os.IsNotExist(err), c.key)
+	}
+}
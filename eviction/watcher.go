@@ -0,0 +1,90 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/fanotify"
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/sirupsen/logrus"
+)
+
+// watcher is the part of inotify.Watcher and fanotify.Watcher used by Notify.
+type watcher interface {
+	AddWatch(path string, flags uint32) error
+	RemoveWatches(path string)
+	Stats() inotify.BufferStats
+	Close() error
+}
+
+// OverflowPolicy decides what happens to file events when the consumer
+// falls behind, see inotify.OverflowPolicy.
+type OverflowPolicy = inotify.OverflowPolicy
+
+// EventBuffer configures how file events are buffered before Notify
+// consumes them.
+type EventBuffer struct {
+	Size      int
+	BatchSize int
+	Policy    OverflowPolicy
+}
+
+// Backend selects how Notify learns about file accesses.
+type Backend string
+
+const (
+	// BackendInotify keeps one inotify watch per directory under the listen dir.
+	BackendInotify Backend = "inotify"
+	// BackendFanotify marks the whole filesystem of the listen dir with
+	// fanotify, it needs no per-directory watches but requires root.
+	BackendFanotify Backend = "fanotify"
+)
+
+// newWatcher starts watching listenPath with the configured backend.
+func (n *Notify) newWatcher(listenPath string) error {
+	cfg := inotify.BufferConfig(n.eventBuffer)
+	switch n.backend {
+	case BackendFanotify:
+		w, err := fanotify.NewBufferedWatcher(listenPath, n.mask(), cfg)
+		if err != nil {
+			return err
+		}
+		n.watcher, n.events, n.errors = w, w.Events, w.Error
+		return nil
+	default:
+		w, err := inotify.NewBufferedWatcher(cfg)
+		if err != nil {
+			return err
+		}
+		n.watcher, n.events, n.errors = w, w.Events, w.Error
+		n.watchTree(listenPath)
+		return nil
+	}
+}
+
+// mask returns the events to subscribe to.
+func (n *Notify) mask() uint32 {
+	return n.weights.mask() | n.openFiles.mask() | n.predictor.mask()
+}
+
+// watchTree adds a watch on root and every directory beneath it.
+func (n *Notify) watchTree(root string) {
+	if n.backend == BackendFanotify {
+		// the filesystem mark already covers it
+		return
+	}
+	filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			logrus.WithError(err).Error("error getting some entries")
+			return nil
+		}
+		if f.IsDir() && f.Name() == diskutil.TrashDir {
+			return filepath.SkipDir
+		}
+		if f.IsDir() {
+			n.watcher.AddWatch(path, n.mask())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,156 @@
+package eviction
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+)
+
+// Weights maps file events to the increment they add to a file's hotness.
+type Weights struct {
+	Create       uint32 // file created in the cache
+	Open         uint32 // file opened
+	CloseWrite   uint32 // file opened for writing was closed
+	CloseNowrite uint32 // file opened read-only was closed
+	MovedTo      uint32 // file renamed into place or moved into the cache
+
+	// BySize scales increments by the size of the file: one more unit per
+	// doubling above 1MiB, as bigger files are more expensive to re-fetch.
+	BySize bool
+	// AC and CAS multiply the increments of action cache and content
+	// addressed storage entries respectively.
+	AC  float64
+	CAS float64
+}
+
+// DefaultWeights are the increments used unless configured otherwise.
+var DefaultWeights = Weights{
+	Create:  10,
+	Open:    1,
+	MovedTo: 10,
+	AC:      1,
+	CAS:     1,
+}
+
+// ParseWeights overrides the event increments of base with a comma
+// separated list of event=increment pairs, for example "create=10,open=1".
+// Events are create, open, close-write, close-nowrite and moved-to.
+func ParseWeights(base Weights, s string) (Weights, error) {
+	w := base
+	if s == "" {
+		return w, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return w, fmt.Errorf("invalid event weight %q, want event=increment", pair)
+		}
+		incr, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return w, fmt.Errorf("invalid increment for %s: %w", name, err)
+		}
+		field := w.field(name)
+		if field == nil {
+			return w, fmt.Errorf("unknown event %q", name)
+		}
+		*field = uint32(incr)
+	}
+	return w, nil
+}
+
+func (w *Weights) field(name string) *uint32 {
+	switch name {
+	case "create":
+		return &w.Create
+	case "open":
+		return &w.Open
+	case "close-write":
+		return &w.CloseWrite
+	case "close-nowrite":
+		return &w.CloseNowrite
+	case "moved-to":
+		return &w.MovedTo
+	}
+	return nil
+}
+
+// mask returns the events to subscribe to, directory creations are always
+// needed to keep watching new directories.
+func (w Weights) mask() uint32 {
+	mask := inotify.InCreate | inotify.InIsdir
+	if w.Open > 0 {
+		mask |= inotify.InOpen
+	}
+	if w.CloseWrite > 0 {
+		mask |= inotify.InCloseWrite
+	}
+	if w.CloseNowrite > 0 {
+		mask |= inotify.InCloseNowrite
+	}
+	if w.MovedTo > 0 {
+		mask |= inotify.InMove
+	}
+	return mask
+}
+
+// increment returns the hotness increment of event for the cache entry
+// key, skipOpen leaves out the weight of an open that was de-duplicated.
+func (w Weights) increment(event *inotify.Event, key string, skipOpen bool) uint32 {
+	var incr uint32
+	if event.HasEvent(inotify.InCreate) {
+		incr += w.Create
+	}
+	if event.HasEvent(inotify.InRename) || event.HasEvent(inotify.InMovedTo) {
+		incr += w.MovedTo
+	}
+	if event.HasEvent(inotify.InOpen) && !skipOpen {
+		incr += w.Open
+	}
+	if event.HasEvent(inotify.InCloseWrite) {
+		incr += w.CloseWrite
+	}
+	if event.HasEvent(inotify.InCloseNowrite) {
+		incr += w.CloseNowrite
+	}
+	if incr == 0 {
+		return 0
+	}
+	scale := 1.0
+	switch entryKind(key) {
+	case kindAC:
+		scale = w.AC
+	case kindCAS:
+		scale = w.CAS
+	}
+	if w.BySize {
+		if f, err := os.Stat(event.Name); err == nil {
+			scale *= float64(1 + bits.Len64(uint64(f.Size())>>20))
+		}
+	}
+	return uint32(math.Round(float64(incr) * scale))
+}
+
+const (
+	kindAC  = "ac"
+	kindCAS = "cas"
+)
+
+// entryKind tells action cache entries from CAS blobs by their directory,
+// following the layout of bazel-remote (ac/, cas/ and their .v2 variants).
+// It returns an empty string for anything else.
+func entryKind(key string) string {
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "ac", "ac.v2":
+			return kindAC
+		case "cas", "cas.v2":
+			return kindCAS
+		}
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package eviction
+
+import (
+	"testing"
+
+	"github.com/hawkingrei/hoshino/eviction/internal/inotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWeights(t *testing.T) {
+	w, err := ParseWeights(DefaultWeights, "open=2, close-write=3")
+	require.NoError(t, err)
+	require.Equal(t, uint32(10), w.Create)
+	require.Equal(t, uint32(2), w.Open)
+	require.Equal(t, uint32(3), w.CloseWrite)
+	require.Equal(t, inotify.InCreate|inotify.InIsdir|inotify.InOpen|inotify.InCloseWrite|inotify.InMove, w.mask())
+
+	_, err = ParseWeights(DefaultWeights, "access=1")
+	require.Error(t, err)
+	_, err = ParseWeights(DefaultWeights, "open")
+	require.Error(t, err)
+}
+
+func TestWeightsIncrement(t *testing.T) {
+	w := DefaultWeights
+	w.AC = 3
+	w.CAS = 0.5
+	open := &inotify.Event{Mask: inotify.InOpen}
+	create := &inotify.Event{Mask: inotify.InCreate | inotify.InOpen}
+	require.Equal(t, uint32(3), w.increment(open, "/cache/ws/ac/abcd", false))
+	require.Equal(t, uint32(0), w.increment(open, "/cache/ws/ac/abcd", true))
+	require.Equal(t, uint32(6), w.increment(create, "/cache/ws/cas.v2/ab/abcd", false))
+	require.Equal(t, uint32(11), w.increment(create, "/cache/ws/other", false))
+}
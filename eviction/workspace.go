@@ -0,0 +1,254 @@
+package eviction
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/sirupsen/logrus"
+)
+
+// Workspaces configures how much of the cache each workspace, the first
+// path segment of a cache key, may use. The workspace named * applies to
+// the workspaces that are not listed.
+//
+// A workspace is written as NAME=KEY=VALUE[,KEY=VALUE...] with the keys
+//
+//	quota    bytes the workspace may use before its oldest entries are
+//	         evicted (K, M, G and T suffixes are powers of 1024)
+//	weight   share of a full disk the workspace keeps relative to the
+//	         others when evicting, 1 by default
+//
+// Workspaces implements flag.Value, each Set adds one workspace.
+type Workspaces map[string]Workspace
+
+// Workspace is the configuration of one workspace.
+type Workspace struct {
+	Quota  int64   // Bytes, 0 for no quota
+	Weight float64 // Fair share weight, 1 if 0
+}
+
+// String implements flag.Value.
+func (w *Workspaces) String() string {
+	if w == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*w))
+	for name := range *w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		ws := (*w)[name]
+		var opts []string
+		if ws.Quota > 0 {
+			opts = append(opts, "quota="+strconv.FormatInt(ws.Quota, 10))
+		}
+		if ws.Weight > 0 {
+			opts = append(opts, "weight="+strconv.FormatFloat(ws.Weight, 'g', -1, 64))
+		}
+		names[i] = name + "=" + strings.Join(opts, ",")
+	}
+	return strings.Join(names, " ")
+}
+
+// Set implements flag.Value.
+func (w *Workspaces) Set(s string) error {
+	name, opts, ok := strings.Cut(s, "=")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid workspace %q: want NAME=KEY=VALUE,...", s)
+	}
+	var ws Workspace
+	for _, opt := range strings.Split(opts, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		var err error
+		switch key {
+		case "quota":
+			ws.Quota, err = ParseBytes(value)
+		case "weight":
+			ws.Weight, err = strconv.ParseFloat(value, 64)
+			if err == nil && ws.Weight <= 0 {
+				err = fmt.Errorf("weight must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid workspace %q: %w", s, err)
+		}
+	}
+	if *w == nil {
+		*w = make(Workspaces)
+	}
+	(*w)[name] = ws
+	return nil
+}
+
+// get returns the configuration of the workspace name.
+func (w Workspaces) get(name string) Workspace {
+	ws, ok := w[name]
+	if !ok {
+		ws = w["*"]
+	}
+	if ws.Weight <= 0 {
+		ws.Weight = 1
+	}
+	return ws
+}
+
+// hasQuotas reports whether a workspace has a quota.
+func (w Workspaces) hasQuotas() bool {
+	for _, ws := range w {
+		if ws.Quota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseBytes parses a byte count with an optional K, M, G or T suffix.
+func ParseBytes(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	shift := 0
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid byte count %q", s)
+	}
+	return n << shift, nil
+}
+
+// workspaceOf returns the workspace of the cache entry at path.
+func (n *Notify) workspaceOf(path string) string {
+	workspace, _, _ := strings.Cut(n.disk.PathToKey(path), "/")
+	return workspace
+}
+
+// enforceQuotas evicts the oldest entries of the workspaces using more
+// than their quota, entries is every entry of the cache.
+func (n *Notify) enforceQuotas(g *guard, entries []diskutil.EntryInfo) {
+	byWorkspace := make(map[string][]diskutil.EntryInfo)
+	usage := make(map[string]int64)
+	for _, entry := range entries {
+		workspace := n.workspaceOf(entry.Path)
+		byWorkspace[workspace] = append(byWorkspace[workspace], entry)
+		usage[workspace] += entry.Size
+	}
+	for workspace, files := range byWorkspace {
+		promMetrics.WorkspaceBytes.WithLabelValues(n.path, workspace).Set(float64(usage[workspace]))
+		quota := n.workspaces.get(workspace).Quota
+		if quota <= 0 || usage[workspace] <= quota {
+			continue
+		}
+		logrus.WithField("workspace", workspace).Infof("%d bytes over quota", usage[workspace]-quota)
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].LastAccess.Before(files[j].LastAccess)
+		})
+		for _, entry := range files {
+			if usage[workspace] <= quota {
+				break
+			}
+			if deleted, _ := n.evict(g, entry, policyQuota); deleted {
+				usage[workspace] -= entry.Size
+			}
+		}
+		if g.plan == nil {
+			promMetrics.WorkspaceBytes.WithLabelValues(n.path, workspace).Set(float64(usage[workspace]))
+		}
+	}
+}
+
+// fairShare orders the eviction candidates of one disk so that the
+// workspace using the most of the disk relative to its weight loses its
+// lowest scoring entry first, used is the usage of the disk by workspace.
+func (n *Notify) fairShare(candidates []diskutil.EntryInfo, used map[string]int64) []diskutil.EntryInfo {
+	now := time.Now()
+	byWorkspace := make(map[string]*shareQueue)
+	for _, entry := range candidates {
+		workspace := n.workspaceOf(entry.Path)
+		q, ok := byWorkspace[workspace]
+		if !ok {
+			q = &shareQueue{
+				workspace: workspace,
+				usage:     float64(used[workspace]),
+				weight:    n.workspaces.get(workspace).Weight,
+			}
+			byWorkspace[workspace] = q
+		}
+		q.entries = append(q.entries, scoredEntry{EntryInfo: entry, score: n.score(entry, now)})
+	}
+	queues := make(shareHeap, 0, len(byWorkspace))
+	for _, q := range byWorkspace {
+		sort.Slice(q.entries, func(i, j int) bool {
+			return q.entries[i].score < q.entries[j].score
+		})
+		queues = append(queues, q)
+	}
+	heap.Init(&queues)
+	ordered := make([]diskutil.EntryInfo, 0, len(candidates))
+	for len(queues) > 0 {
+		q := queues[0]
+		entry := q.entries[0]
+		ordered = append(ordered, entry.EntryInfo)
+		q.entries = q.entries[1:]
+		q.usage -= float64(entry.Size)
+		if len(q.entries) == 0 {
+			heap.Pop(&queues)
+		} else {
+			heap.Fix(&queues, 0)
+		}
+	}
+	return ordered
+}
+
+type scoredEntry struct {
+	diskutil.EntryInfo
+	score float64
+}
+
+// shareQueue holds the eviction candidates of one workspace.
+type shareQueue struct {
+	workspace string
+	usage     float64
+	weight    float64
+	entries   []scoredEntry
+}
+
+// shareHeap puts the workspace using the most relative to its weight first.
+type shareHeap []*shareQueue
+
+func (h shareHeap) Len() int { return len(h) }
+func (h shareHeap) Less(i, j int) bool {
+	si, sj := h[i].usage/h[i].weight, h[j].usage/h[j].weight
+	if si != sj {
+		return si > sj
+	}
+	return h[i].workspace < h[j].workspace
+}
+func (h shareHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *shareHeap) Push(x interface{}) { *h = append(*h, x.(*shareQueue)) }
+func (h *shareHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return q
+}
+
+// workspaceUsage sums the size of entries by workspace.
+func (n *Notify) workspaceUsage(entries []diskutil.EntryInfo) map[string]int64 {
+	usage := make(map[string]int64)
+	for _, entry := range entries {
+		usage[n.workspaceOf(entry.Path)] += entry.Size
+	}
+	return usage
+}
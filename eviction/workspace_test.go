@@ -0,0 +1,81 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction/internal/heavykeeper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkspaces(t *testing.T) {
+	for s, expected := range map[string]int64{"512": 512, "2K": 2048, "3mb": 3 << 20, "1G": 1 << 30} {
+		actual, err := ParseBytes(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, actual, s)
+	}
+	for _, s := range []string{"", "G", "-1", "1P", "9999999T"} {
+		_, err := ParseBytes(s)
+		require.Error(t, err, s)
+	}
+
+	var ws Workspaces
+	require.NoError(t, ws.Set("main=weight=4"))
+	require.NoError(t, ws.Set("*=quota=1G,weight=0.5"))
+	require.Error(t, ws.Set("pr=quota=1X"))
+	require.Error(t, ws.Set("pr=weight=0"))
+	require.Error(t, ws.Set("pr=color=red"))
+	require.Equal(t, "*=quota=1073741824,weight=0.5 main=weight=4", ws.String())
+	require.Equal(t, Workspace{Weight: 4}, ws.get("main"))
+	require.Equal(t, Workspace{Quota: 1 << 30, Weight: 0.5}, ws.get("pr-1"))
+	require.Equal(t, Workspace{Weight: 1}, Workspaces(nil).get("main"))
+}
+
+func TestFairShare(t *testing.T) {
+	var ws Workspaces
+	require.NoError(t, ws.Set("main=weight=3"))
+	n := &Notify{disk: diskutil.NewCache("/cache"), heavykeeper: heavykeeper.NewHeavyKeeper(10, 100, 4, 0.9, 1), workspaces: ws}
+	now := time.Now()
+	entry := func(key string, age time.Duration) diskutil.EntryInfo {
+		return diskutil.EntryInfo{Path: "/cache/" + key, LastAccess: now.Add(-age), Size: 10}
+	}
+	candidates := []diskutil.EntryInfo{
+		entry("main/cas/a", 3*time.Hour),
+		entry("main/cas/b", 2*time.Hour),
+		entry("pr/cas/a", time.Hour),
+		entry("pr/cas/b", 2*time.Hour),
+	}
+	// main uses 45 bytes with weight 3, pr 30 bytes with weight 1
+	used := map[string]int64{"main": 45, "pr": 30}
+	var order []string
+	for _, e := range n.fairShare(candidates, used) {
+		order = append(order, n.disk.PathToKey(e.Path))
+	}
+	require.Equal(t, []string{"pr/cas/b", "pr/cas/a", "main/cas/a", "main/cas/b"}, order)
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	dir := t.TempDir()
+	var ws Workspaces
+	require.NoError(t, ws.Set("pr=quota=2K"))
+	n := &Notify{path: dir, disk: diskutil.NewCache(dir), openFiles: newOpenFiles(true, false), workspaces: ws}
+	now := time.Now()
+	for i, key := range []string{"pr/cas/a", "pr/cas/b", "pr/cas/c", "main/cas/a", "main/cas/b", "main/cas/c"} {
+		path := filepath.Join(dir, key)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 1024), 0644))
+		at := now.Add(-time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(path, at, at))
+	}
+	n.enforceQuotas(n.newGuard(triggerQuota), n.disk.GetEntries())
+	for key, exists := range map[string]bool{
+		"pr/cas/a": true, "pr/cas/b": true, "pr/cas/c": false,
+		"main/cas/a": true, "main/cas/b": true, "main/cas/c": true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, key))
+		require.Equal(t, exists, err == nil, key)
+	}
+}
@@ -28,12 +28,16 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hawkingrei/hoshino/diskutil"
@@ -44,21 +48,85 @@ import (
 
 var ListenDir = flag.String("listen-dir", "", "location to store cache entries on disk")
 var dir = flag.String("dir", "", "location to store cache entries on disk")
+var configPath = flag.String("config", "",
+	"YAML config file, its disks section lists more listen-dir / dir pairs with their own thresholds and path-map rules")
 var host = flag.String("host", "", "host address to listen on")
 var cachePort = flag.Int("cache-port", 8080, "port to listen on for cache requests")
 var metricsPort = flag.Int("metrics-port", 9092, "port to listen on for prometheus metrics scraping")
 var pprofPort = flag.Int("pprof-port", 9091, "port to listen on for pprof")
+var adminPort = flag.Int("admin-port", 9093, "port to listen on for the admin API")
+var adminHost = flag.String("admin-host", "localhost",
+	"host address the admin API listens on, it is unauthenticated and can delete cache entries")
 var level = flag.Int("level", 3, "compression level")
+var watcherBackend = flag.String("watcher", string(eviction.BackendInotify),
+	"how to watch --listen-dir: inotify (one watch per directory) or fanotify (whole filesystem, requires root)")
+var eventBufferSize = flag.Int("event-buffer-size", 1<<16, "number of file events buffered for the eviction loop")
+var eventBatchSize = flag.Int("event-batch-size", 512, "maximum number of file events handed to the eviction loop at once")
+var eventOverflow eviction.OverflowPolicy
+var openDedupeWindow = flag.Duration("open-dedupe-window", 0,
+	"count repeated opens of the same file within this window once, 0 disables it")
+var openDedupePerSession = flag.Bool("open-dedupe-per-session", true,
+	"track --open-dedupe-window per process session (needs --watcher=fanotify)")
+var eventWeights = flag.String("event-weights", "",
+	"comma separated event=increment hotness weights overriding the defaults (create=10,open=1,moved-to=10), "+
+		"events are create, open, close-write, close-nowrite and moved-to")
+var weightBySize = flag.Bool("weight-by-size", false, "scale hotness increments by file size")
+var acWeight = flag.Float64("ac-weight", 1, "multiplier of hotness increments for action cache entries")
+var casWeight = flag.Float64("cas-weight", 1, "multiplier of hotness increments for CAS entries")
+var pathMapping eviction.PathMapping
+var pinRules eviction.PinRules
+var ttlRules eviction.TTLRules
+var workspaces eviction.Workspaces
+var classWeights eviction.ClassWeights
+var classRules eviction.ClassRules
+var rulesPath = flag.String("rules", "",
+	"YAML file of keep, ttl and priority rules matching entries by path, kind, age and size, reloaded when it "+
+		"changes and checked with \"hoshino rules test FILE\", disks in --config may set their own")
+var ttlInterval = flag.Duration("ttl-interval", time.Hour, "interval between deleting the entries past their --ttl")
+var openFileCheck = flag.Bool("open-file-check", false,
+	"keep entries that are open, as tracked through open and close events, when evicting. "+
+		"It subscribes to the close events of every file, about doubling the event volume")
+var openFileProcScan = flag.Bool("open-file-proc-scan", false,
+	"also keep entries held open by any process visible in /proc, checked once per eviction run")
+var minEntryAge = flag.Duration("min-entry-age", 0,
+	"never evict entries created less than this long ago, so a build's CAS blobs outlive the build, 0 disables it")
 var metricsUpdateInterval = flag.Duration("metrics-update-interval", time.Second*10,
 	"interval between updating disk metrics")
 
 // eviction knobs
 var minPercentBlocksFree = flag.Float64("min-percent-blocks-free", 5,
-	"minimum percent of blocks free on --dir's disk before evicting entries")
+	"minimum percent of blocks free on each disk holding --dir before evicting entries from it")
 var evictUntilPercentBlocksFree = flag.Float64("evict-until-percent-blocks-free", 20,
 	"continue evicting from the cache until at least this percent of blocks are free")
 var diskCheckInterval = flag.Duration("disk-check-interval", time.Second*10,
 	"interval between checking disk usage (and potentially evicting entries)")
+var auditLogPath = flag.String("audit-log", "",
+	"JSON lines file recording every eviction and a summary of every eviction pass, disabled if empty")
+var auditLogMaxSize = flag.String("audit-log-max-size", "100M", "size at which the --audit-log is rotated")
+var auditLogMaxFiles = flag.Int("audit-log-max-files", 5, "number of rotated --audit-log files to keep")
+var trashDelay = flag.Duration("trash-delay", 0,
+	"move evicted entries into a trash dir on their filesystem, purged after this delay or when the disk runs "+
+		"below --min-percent-blocks-free, so that they can be restored with \"hoshino trash restore\", 0 deletes them")
+var dryRun = flag.Bool("dry-run", false,
+	"log and count the entries eviction would delete instead of deleting them, see \"hoshino evict plan\"")
+var evictRateFiles = flag.Float64("evict-rate-files", 0,
+	"maximum number of entries evicted a second, 0 is unlimited")
+var evictRateBytes = flag.String("evict-rate-bytes", "0",
+	"maximum number of bytes evicted a second, with an optional K, M, G or T suffix, 0 is unlimited")
+var evictIdleIO = flag.Bool("evict-idle-io", false,
+	"evict in the idle IO class so that deletions only use the disk when nothing else does")
+var emergencyPercentBlocksFree = flag.Float64("emergency-percent-blocks-free", 0,
+	"hard floor of percent of blocks free, below --min-percent-blocks-free, under which a disk is evicted at once, largest and coldest entries first "+
+		"and ignoring --evict-rate-files and --evict-rate-bytes, until it is back above --min-percent-blocks-free, 0 disables it")
+var emergencyColdWorkspace = flag.Duration("emergency-cold-workspace", 0,
+	"delete whole the workspaces unused for this long first in an emergency, 0 keeps them")
+var predictLead = flag.Duration("predict-lead", 0,
+	"evict a disk as soon as its fill rate would take it below --min-percent-blocks-free within this time, "+
+		"0 only evicts once it is there")
+var stateDir = flag.String("state-dir", "",
+	"directory keeping the queue of entries expelled from the top-k across restarts, kept in memory only if empty")
+var discoverMounts = flag.Bool("discover-mounts", true,
+	"watch /proc/self/mountinfo for disks mounted beneath --listen-dir and evict each of them on its own")
 
 // global metrics object, see prometheus.go
 var promMetrics *prometheusMetrics
@@ -72,18 +140,137 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rules":
+			os.Exit(rulesCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "evict":
+			os.Exit(evictCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "trash":
+			os.Exit(trashCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+	flag.Var(&eventOverflow, "event-overflow",
+		"what to do when the file event buffer is full: block, drop-oldest or coalesce")
+	flag.Var(&pathMapping, "path-map",
+		"rule mapping paths under --listen-dir to paths under --dir, may be repeated and the first match wins: "+
+			"strip:N, regex:RE=>TEMPLATE or identity (default strip:1), disks in --config may set their own")
+	flag.Var(&pinRules, "pin",
+		"rule for cache entries that are never evicted, may be repeated: glob:PATTERN matching the leading "+
+			"segments of keys below --dir (e.g. release-* for whole workspaces), prefix:STRING or regex:RE")
+	flag.Var(&ttlRules, "ttl",
+		"PATTERN=DURATION rule deleting the entries matching PATTERN (see --pin) once they were not accessed "+
+			"for DURATION, whatever the free space, may be repeated and the first match wins")
+	flag.Var(&workspaces, "workspace",
+		"NAME=quota=SIZE,weight=W configuring a workspace (first path segment below --dir), may be repeated: "+
+			"quota evicts its oldest entries beyond SIZE, weight is its share of a full disk (default 1), "+
+			"the workspace * applies to unlisted ones")
+	flag.Var(&classWeights, "class",
+		"NAME=WEIGHT priority class scaling the eviction score of its entries (e.g. main-ci=4), may be repeated")
+	flag.Var(&classRules, "class-rule",
+		"PATTERN=CLASS rule assigning the entries matching PATTERN (see --pin) to a --class, may be repeated "+
+			"and the first match wins")
 	flag.Parse()
-	if *dir == "" {
-		logrus.Fatal("--dir must be set!")
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid --config")
+	}
+	disks, err := resolveDisks(cfg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *rulesPath != "" {
+		if _, err := eviction.LoadRules(*rulesPath); err != nil {
+			logrus.WithError(err).Fatal("invalid --rules")
+		}
+	}
+	backend := eviction.Backend(*watcherBackend)
+	if backend != eviction.BackendInotify && backend != eviction.BackendFanotify {
+		logrus.Fatalf("unknown --watcher %q", *watcherBackend)
+	}
+	weights, err := eviction.ParseWeights(eviction.DefaultWeights, *eventWeights)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid --event-weights")
+	}
+	weights.BySize = *weightBySize
+	weights.AC = *acWeight
+	weights.CAS = *casWeight
+
+	rateBytes, err := eviction.ParseBytes(*evictRateBytes)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid --evict-rate-bytes")
 	}
-	if *ListenDir == "" {
-		logrus.Fatal("--listen-dir must be set!")
+
+	if *stateDir != "" {
+		if err := os.MkdirAll(*stateDir, 0755); err != nil {
+			logrus.WithError(err).Fatal("invalid --state-dir")
+		}
 	}
-	notify := eviction.New(*dir, *ListenDir, *minPercentBlocksFree, *evictUntilPercentBlocksFree)
-	go notify.Start()
-	go notify.Background()
 
-	go updateMetrics(*metricsUpdateInterval, *dir)
+	var auditLog *eviction.AuditLog
+	if *auditLogPath != "" {
+		maxSize, err := eviction.ParseBytes(*auditLogMaxSize)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid --audit-log-max-size")
+		}
+		auditLog, err = eviction.NewAuditLog(*auditLogPath, maxSize, *auditLogMaxFiles)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid --audit-log")
+		}
+		defer auditLog.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := range disks {
+		d := &disks[i]
+		opts := []eviction.Option{
+			eviction.WithBackend(backend),
+			eviction.WithEventBuffer(eviction.EventBuffer{
+				Size:      *eventBufferSize,
+				BatchSize: *eventBatchSize,
+				Policy:    eventOverflow,
+			}),
+			eviction.WithOpenDedupe(*openDedupeWindow, *openDedupePerSession),
+			eviction.WithWeights(weights),
+			eviction.WithPathMapping(d.pathMapping),
+			eviction.WithOpenFileCheck(*openFileCheck, *openFileProcScan),
+			eviction.WithMinAge(*minEntryAge),
+			eviction.WithPinRules(d.pins),
+			eviction.WithTTLRules(d.ttls, *ttlInterval),
+			eviction.WithWorkspaces(d.workspaces),
+			eviction.WithClasses(d.classes),
+			eviction.WithRules(d.Rules),
+			eviction.WithDryRun(*dryRun),
+			eviction.WithAuditLog(auditLog),
+			eviction.WithTrash(*trashDelay),
+			eviction.WithRateLimit(*evictRateFiles, float64(rateBytes), *evictIdleIO),
+			eviction.WithEmergency(*d.EmergencyPercentBlocksFree, *emergencyColdWorkspace),
+			eviction.WithPrediction(*predictLead),
+		}
+		if *stateDir != "" {
+			opts = append(opts, eviction.WithCandidatesFile(eviction.CandidatesPath(*stateDir, d.Dir)))
+		}
+		if *discoverMounts {
+			opts = append(opts, eviction.WithMountDiscovery(*diskCheckInterval))
+		}
+		notify := eviction.New(d.Dir, d.ListenDir, *d.MinPercentBlocksFree, *d.EvictUntilPercentBlocksFree, opts...)
+		d.notify = notify
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notify.Start(ctx)
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notify.Background(ctx)
+		}()
+
+		go updateMetrics(*metricsUpdateInterval, d.Dir)
+	}
 
 	// listen for prometheus scraping
 	metricsMux := http.NewServeMux()
@@ -104,10 +291,25 @@ func main() {
 	pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	pprofAddr := fmt.Sprintf("%s:%d", *host, *pprofPort)
-	logrus.Infof("pprof Listening on: %s", pprofAddr)
-	logrus.WithField("mux", "pprof").WithError(
-		http.ListenAndServe(pprofAddr, pprofMux),
-	).Fatal("ListenAndServe returned.")
+	go func() {
+		logrus.Infof("pprof Listening on: %s", pprofAddr)
+		logrus.WithField("mux", "pprof").WithError(
+			http.ListenAndServe(pprofAddr, pprofMux),
+		).Fatal("ListenAndServe returned.")
+	}()
+
+	// listen for the admin API
+	adminAddr := fmt.Sprintf("%s:%d", *adminHost, *adminPort)
+	go func() {
+		logrus.Infof("Admin Listening on: %s", adminAddr)
+		logrus.WithField("mux", "admin").WithError(
+			http.ListenAndServe(adminAddr, newAdminMux(disks)),
+		).Fatal("ListenAndServe returned.")
+	}()
+
+	<-ctx.Done()
+	logrus.Info("Shutting down")
+	wg.Wait()
 }
 
 // file not found error, used below
@@ -122,9 +324,9 @@ func updateMetrics(interval time.Duration, diskRoot string) {
 		if err != nil {
 			logger.WithError(err).Error("Failed to get disk metrics")
 		} else {
-			promMetrics.DiskFree.Set(float64(bytesFree) / 1e9)
-			promMetrics.DiskUsed.Set(float64(bytesUsed) / 1e9)
-			promMetrics.DiskTotal.Set(float64(bytesFree+bytesUsed) / 1e9)
+			promMetrics.DiskFree.WithLabelValues(diskRoot).Set(float64(bytesFree) / 1e9)
+			promMetrics.DiskUsed.WithLabelValues(diskRoot).Set(float64(bytesUsed) / 1e9)
+			promMetrics.DiskTotal.WithLabelValues(diskRoot).Set(float64(bytesFree+bytesUsed) / 1e9)
 		}
 	}
 }
@@ -66,9 +66,9 @@ func (d *DefaultFieldsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 // prometheusMetrics are served by /prometheus on the metrics port
 type prometheusMetrics struct {
-	DiskFree             prometheus.Gauge
-	DiskUsed             prometheus.Gauge
-	DiskTotal            prometheus.Gauge
+	DiskFree             *prometheus.GaugeVec
+	DiskUsed             *prometheus.GaugeVec
+	DiskTotal            *prometheus.GaugeVec
 	FilesEvicted         prometheus.Counter
 	ActionCacheHits      prometheus.Counter
 	CASHits              prometheus.Counter
@@ -79,18 +79,18 @@ type prometheusMetrics struct {
 
 func initMetrics() *prometheusMetrics {
 	metrics := &prometheusMetrics{
-		DiskFree: prometheus.NewGauge(prometheus.GaugeOpts{
+		DiskFree: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "bazel_cache_disk_free",
 			Help: "Free gb on bazel cache disk",
-		}),
-		DiskUsed: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"dir"}),
+		DiskUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "bazel_cache_disk_used",
 			Help: "Used gb on bazel cache disk",
-		}),
-		DiskTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"dir"}),
+		DiskTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "bazel_cache_disk_total",
 			Help: "Total gb on bazel cache disk",
-		}),
+		}, []string{"dir"}),
 		FilesEvicted: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "bazel_cache_evicted_files",
 			Help: "number of files evicted since last server start",
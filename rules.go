@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hawkingrei/hoshino/diskutil"
+	"github.com/hawkingrei/hoshino/eviction"
+	"github.com/sirupsen/logrus"
+)
+
+const rulesUsage = `usage: hoshino rules test [-dir DIR] [-now TIME] FILE
+
+Checks the eviction rules in FILE, with -dir it prints what the rules decide
+for every entry of the cache in DIR as one JSON object per line. Hotness is
+only known to a running daemon, it is 0 here.
+`
+
+// rulesCommand runs "hoshino rules", args follow the command name, and
+// returns the exit code
+func rulesCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprint(stderr, rulesUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, rulesUsage)
+		fs.PrintDefaults()
+	}
+	dir := fs.String("dir", "", "cache dir whose entries the rules are evaluated for")
+	nowFlag := fs.String("now", "", "RFC 3339 time the rules are evaluated at, the current time by default")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	rules, err := eviction.LoadRules(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "%s: %s\n", fs.Arg(0), rules)
+	if *dir == "" {
+		return 0
+	}
+	now := time.Now()
+	if *nowFlag != "" {
+		if now, err = time.Parse(time.RFC3339, *nowFlag); err != nil {
+			fmt.Fprintf(stderr, "invalid -now: %v\n", err)
+			return 2
+		}
+	}
+	// entries that vanish while walking the cache are logged, keep them
+	// apart from the decisions
+	logrus.SetOutput(stderr)
+	if err := printDecisions(rules, diskutil.NewCache(*dir), now, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// ruleResult is one line of "hoshino rules test -dir"
+type ruleResult struct {
+	eviction.Entry
+	eviction.Decision
+}
+
+// printDecisions writes the decision of rules for every entry of cache
+func printDecisions(rules *eviction.Rules, cache *diskutil.Cache, now time.Time, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, info := range cache.GetEntries() {
+		entry := eviction.NewEntry(cache.PathToKey(info.Path), info)
+		result := ruleResult{Entry: entry, Decision: rules.Decide(entry, now)}
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
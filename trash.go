@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const trashUsage = `usage: hoshino trash restore [-admin ADDR] [-listen-dir DIR] [-workspace NAME] [-since TIME] [-until TIME]
+
+Makes a running daemon move the entries evicted into its trash (see
+--trash-delay) back into the cache, all of them or those of a workspace or
+evicted within a time range, given in RFC 3339. Entries written again since
+they were evicted stay in the trash.
+`
+
+// trashCommand runs "hoshino trash", args follow the command name, and
+// returns the exit code
+func trashCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "restore" {
+		fmt.Fprint(stderr, trashUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("trash restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, trashUsage)
+		fs.PrintDefaults()
+	}
+	admin := fs.String("admin", "localhost:9093", "admin address of the daemon, see --admin-port")
+	listenDir := fs.String("listen-dir", "", "restore only into the disk with this --listen-dir")
+	workspace := fs.String("workspace", "", "restore only the entries of this workspace")
+	since := fs.String("since", "", "restore only the entries evicted at or after this time")
+	until := fs.String("until", "", "restore only the entries evicted before this time")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"listen-dir": *listenDir,
+		"workspace":  *workspace,
+		"since":      *since,
+		"until":      *until,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if err := callAdmin(http.MethodPost, *admin, "/trash/restore", query, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}